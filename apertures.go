@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+	"image"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Named measurement apertures: the target, comparison stars, the flash region and so on. Each one
+// gets its own lightcurve over the folder, and the target is divided by the sum of the comparisons
+// to give a ratio curve in which transparency changes cancel. The apertures are kept in
+// apertures.json in the FITS folder, so they come back when the folder is opened again.
+// An aperture is a rectangle (summed as it is) or a circle with a sky annulus - see photometry.go.
+// It can follow a drifting star, or be tied to one that does - see tracking.go.
+
+const apertureFileName = "apertures.json"
+
+const roleTarget = "target"
+const roleComparison = "comparison"
+const roleFlash = "flash"
+const roleOther = "other"
+
+var apertureRoles = []string{roleTarget, roleComparison, roleFlash, roleOther}
+
+const noTie = "(none)" // The "Move with aperture" choice of an aperture that is not tied to another one
+
+type aperture struct {
+	Name     string  `json:"name"`
+	Role     string  `json:"role"`
+	Shape    string  `json:"shape,omitempty"` // shapeRectangle (or "" in files written before there were circles) or shapeCircle
+	X0       int     `json:"x0"`              // The same rectangle convention as the ROI: x1 and y1 are just outside it
+	Y0       int     `json:"y0"`              // For a circle, the rectangle is the ROI it was made from
+	X1       int     `json:"x1"`
+	Y1       int     `json:"y1"`
+	CenterX  float64 `json:"centerX,omitempty"` // Circle center in image coordinates (pixel 0 spans 0 to 1)
+	CenterY  float64 `json:"centerY,omitempty"`
+	Radius   float64 `json:"radius,omitempty"`
+	SkyInner float64 `json:"skyInner,omitempty"` // Radii of the sky annulus
+	SkyOuter float64 `json:"skyOuter,omitempty"`
+	// Tracking - see tracking.go
+	Track        bool    `json:"track,omitempty"`        // Recenter on the centroid every frame
+	SearchRadius float64 `json:"searchRadius,omitempty"` // Around the previous position
+	DriftLimit   float64 `json:"driftLimit,omitempty"`   // Largest accepted move from one frame to the next (pixels)
+	TiedTo       string  `json:"tiedTo,omitempty"`       // Name of the aperture whose offset this one follows
+}
+
+type apertureResults struct {
+	apertures []aperture     // As they were when measured
+	curves    [][]float64    // [aperture][frame index] - NaN for dropped frames
+	sky       [][]float64    // [aperture][frame index] - sky per pixel, NaN for rectangles
+	noise     [][]float64    // [aperture][frame index] - noise of the flux, NaN for rectangles
+	ratio     []float64      // target / sum of comparisons - nil without both
+	centers   [][]imagePoint // [aperture][frame index] - where the aperture was measured
+	timestamp []string       // Per frame index - "" for dropped frames (a placeholder file has its own)
+	dropped   []bool         // Per frame index - a dropped frame or a placeholder file for one
+	paths     []string       // myWin.fitsFilePaths when measured
+}
+
+func (a aperture) rect() image.Rectangle {
+	return image.Rect(a.X0, a.Y0, a.X1, a.Y1)
+}
+
+func (a aperture) description() string {
+	tracking := ""
+	if a.TiedTo != "" {
+		tracking = "  tied to " + a.TiedTo
+	} else if a.Track {
+		tracking = fmt.Sprintf("  tracked (search %0.1f  drift limit %0.1f)", a.SearchRadius, a.DriftLimit)
+	}
+	if a.Shape == shapeCircle {
+		return fmt.Sprintf("%s (%s)  circle at %0.1f, %0.1f  radius %0.1f  sky %0.1f to %0.1f%s",
+			a.Name, a.Role, a.CenterX, a.CenterY, a.Radius, a.SkyInner, a.SkyOuter, tracking)
+	}
+	return fmt.Sprintf("%s (%s)  x: %d to %d  y: %d to %d%s", a.Name, a.Role, a.X0, a.X1-1, a.Y0, a.Y1-1, tracking)
+}
+
+func apertureFilePath() string {
+	return filepath.Join(myWin.folderSelected, apertureFileName)
+}
+
+func loadApertures() {
+	// Called for every folder opened. A folder without apertures.json has no apertures.
+	myWin.apertures = nil
+	myWin.apertureResults = nil
+	data, err := os.ReadFile(apertureFilePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &myWin.apertures)
+	}
+	if err != nil {
+		log.Printf("could not read %s: %s\n", apertureFilePath(), err)
+		return
+	}
+	log.Printf("%d apertures read from %s\n", len(myWin.apertures), apertureFilePath())
+	if removeDanglingTies() {
+		saveApertures()
+	}
+}
+
+func saveApertures() {
+	data, err := json.MarshalIndent(myWin.apertures, "", "  ")
+	if err == nil {
+		err = os.WriteFile(apertureFilePath(), data, 0644)
+	}
+	if err != nil {
+		dialog.ShowInformation("Apertures", fmt.Sprintf("Could not save %s\n%s", apertureFilePath(), err),
+			myWin.parentWindow)
+	}
+}
+
+func apertureSum(frame *frameData, rect image.Rectangle) float64 {
+	// Sum of the valid pixels in rect - NaN when rect is entirely off the frame
+	rect = rect.Intersect(image.Rect(0, 0, frame.width, frame.height))
+	if rect.Empty() {
+		return math.NaN()
+	}
+	sum := 0.0
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if value := frame.at(x, y); !math.IsNaN(value) {
+				sum += value
+			}
+		}
+	}
+	return sum
+}
+
+func ratioCurve(apertures []aperture, curves [][]float64) []float64 {
+	// The first target over the sum of the comparisons
+	target := -1
+	var comparisons []int
+	for i, a := range apertures {
+		if a.Role == roleTarget && target < 0 {
+			target = i
+		} else if a.Role == roleComparison {
+			comparisons = append(comparisons, i)
+		}
+	}
+	if target < 0 || len(comparisons) == 0 {
+		return nil
+	}
+	ratio := make([]float64, len(curves[target]))
+	for k := range ratio {
+		comparison := 0.0
+		for _, i := range comparisons {
+			comparison += curves[i][k] // NaN (a dropped frame) carries through
+		}
+		if comparison > 0 {
+			ratio[k] = curves[target][k] / comparison
+		} else {
+			ratio[k] = math.NaN()
+		}
+	}
+	return ratio
+}
+
+func measureApertures(apertures []aperture, progress *widget.ProgressBar) (*apertureResults, error) {
+	paths := make([]string, len(myWin.fitsFilePaths))
+	copy(paths, myWin.fitsFilePaths)
+	results := &apertureResults{apertures: apertures, paths: paths, timestamp: make([]string, len(paths)),
+		dropped: make([]bool, len(paths))}
+	results.curves = make([][]float64, len(apertures))
+	results.sky = make([][]float64, len(apertures))
+	results.noise = make([][]float64, len(apertures))
+	results.centers = make([][]imagePoint, len(apertures))
+	start := make([]imagePoint, len(apertures))
+	current := make([]imagePoint, len(apertures)) // Carried from frame to frame (and over dropped frames)
+	for i, a := range apertures {
+		results.curves[i] = make([]float64, len(paths))
+		results.sky[i] = make([]float64, len(paths))
+		results.noise[i] = make([]float64, len(paths))
+		results.centers[i] = make([]imagePoint, len(paths))
+		start[i] = a.center()
+		current[i] = start[i]
+	}
+	numRejected := 0
+	for k, path := range paths {
+		progress.SetValue(float64(k) / float64(len(paths)))
+		var frame *frameData
+		results.dropped[k] = path == droppedFrameString
+		if path != droppedFrameString {
+			// A placeholder file is a dropped frame too - its blank image is not a measurement. Without
+			// apertures (the timestamps for a lightcurve csv, say) only the header is needed.
+			timestamp, placeholder, err := readFrameHeader(path)
+			if err == nil && !placeholder && len(apertures) > 0 {
+				frame, _, timestamp, err = loadFrame(path)
+			}
+			if err != nil {
+				return nil, err
+			}
+			results.timestamp[k] = timestamp
+			results.dropped[k] = placeholder
+		}
+		if frame != nil {
+			numRejected += trackApertures(frame, apertures, start, current)
+		}
+		for i, a := range apertures {
+			results.centers[i][k] = current[i]
+			if frame == nil {
+				results.curves[i][k], results.sky[i][k], results.noise[i][k] = math.NaN(), math.NaN(), math.NaN()
+			} else {
+				measured := measureAperture(frame, a.movedTo(current[i]))
+				results.curves[i][k], results.sky[i][k], results.noise[i][k] = measured.flux, measured.sky, measured.noise
+			}
+		}
+	}
+	results.ratio = ratioCurve(apertures, results.curves)
+	if numRejected > 0 {
+		log.Printf("%d tracking centroids were rejected (beyond the drift limit or nothing above the sky)\n", numRejected)
+	}
+	return results, nil
+}
+
+func curvePoints(curve []float64) plotter.XYs {
+	// Dropped frames are left out, as they are in buildPlot()
+	var pts plotter.XYs
+	for k, value := range curve {
+		if !isMissingSample(value) {
+			pts = append(pts, plotter.XY{X: float64(k), Y: value})
+		}
+	}
+	return pts
+}
+
+func aperturePlotFileName(i int) string {
+	return fmt.Sprintf("aperture%dLightcurve.png", i+1)
+}
+
+func buildAperturePlots(results *apertureResults) {
+	// Writes a lightcurve per aperture (and apertureRatio.png when there is a ratio) in the current working directory
+	for i := range results.apertures {
+		buildAperturePlot(results, i, aperturePlotFileName(i))
+	}
+	if results.ratio == nil {
+		return
+	}
+
+	plot.DefaultFont = font.Font{Typeface: "Liberation", Variant: "Sans", Style: 0, Weight: 3, Size: font.Points(20)}
+	plotutil.DefaultGlyphShapes[0] = plotutil.Shape(5) // set point shape to filled circle
+
+	plt := plot.New()
+	plt.X.Min = 0
+	plt.X.Max = float64(len(results.paths))
+	plt.Title.Text = "target / comparison ratio"
+	plt.X.Label.Text = "frame index"
+	plt.Y.Label.Text = "ratio"
+	err := plotutil.AddScatters(plt, curvePoints(results.ratio))
+	if err != nil {
+		panic(err)
+	}
+	err = plt.Save(21*vg.Inch, 6*vg.Inch, "apertureRatio.png")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func showAperturePlots(results *apertureResults) {
+	buildAperturePlots(results)
+
+	plotWin := myWin.App.NewWindow("aperture lightcurves")
+	plotWin.Resize(fyne.Size{Height: 900, Width: 1500})
+	fileNames := make([]string, 0, len(results.apertures)+1)
+	for i := range results.apertures {
+		fileNames = append(fileNames, aperturePlotFileName(i))
+	}
+	if results.ratio != nil {
+		fileNames = append(fileNames, "apertureRatio.png")
+	}
+	plots := container.NewVBox()
+	for _, fileName := range fileNames {
+		plotImage := canvas.NewImageFromFile(fileName)
+		plotImage.FillMode = canvas.ImageFillContain
+		plotImage.SetMinSize(fyne.Size{Width: 1400, Height: 400})
+		plots.Add(plotImage)
+	}
+	plotWin.SetContent(container.NewVScroll(plots))
+	plotWin.CenterOnScreen()
+	plotWin.Show()
+}
+
+func runApertureMeasurement(win fyne.Window) {
+	if len(myWin.fitsFilePaths) == 0 || len(myWin.apertures) == 0 {
+		dialog.ShowInformation("Apertures", "Open a folder and add at least one aperture first.", win)
+		return
+	}
+	apertures := make([]aperture, len(myWin.apertures))
+	copy(apertures, myWin.apertures)
+	progress := widget.NewProgressBar()
+	busy := dialog.NewCustomWithoutButtons("Measuring apertures", progress, win)
+	busy.Show()
+	go func() {
+		results, err := measureApertures(apertures, progress)
+		busy.Hide()
+		if err != nil {
+			dialog.ShowInformation("Apertures", err.Error(), win)
+			return
+		}
+		myWin.apertureResults = results
+		if myWin.showAperturePaths && myWin.imageView != nil {
+			myWin.imageView.placeTrackOverlay()
+		}
+		log.Printf("%d apertures measured over %d frames  %s\n", len(apertures), len(results.paths),
+			calibrationDescription())
+		log.Printf("sky level: %s  gain: %g electrons per ADU\n", myWin.skyMethod, myWin.photometryGain)
+		for _, a := range apertures {
+			log.Printf("    %s\n", a.description())
+		}
+		showAperturePlots(results)
+	}()
+}
+
+func showApertureWindow() {
+	trace("")
+	apertureWin := myWin.App.NewWindow("Apertures")
+	apertureWin.Resize(fyne.Size{Height: 650, Width: 700})
+
+	selected := -1
+	apertureList := widget.NewList(
+		func() int { return len(myWin.apertures) },
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			item.(*widget.Label).SetText(myWin.apertures[id].description())
+		})
+	apertureList.OnSelected = func(id widget.ListItemID) { selected = id }
+	apertureList.OnUnselected = func(_ widget.ListItemID) { selected = -1 }
+
+	nameEntry := widget.NewEntry()
+	nameEntry.SetPlaceHolder("name")
+	roleSelector := widget.NewSelect(apertureRoles, nil)
+	roleSelector.SetSelected(roleTarget)
+	shapeSelector := widget.NewSelect([]string{shapeRectangle, shapeCircle}, nil)
+	shapeSelector.SetSelected(shapeCircle)
+	skyInnerEntry := widget.NewEntry()
+	skyInnerEntry.SetPlaceHolder("1.5 x radius")
+	skyOuterEntry := widget.NewEntry()
+	skyOuterEntry.SetPlaceHolder("2.5 x radius")
+
+	trackCheck := widget.NewCheck("Recenter on the centroid every frame", nil)
+	searchEntry := widget.NewEntry()
+	searchEntry.SetPlaceHolder("2 x radius")
+	driftEntry := widget.NewEntry()
+	driftEntry.SetPlaceHolder("3")
+	tieSelector := widget.NewSelect(nil, nil)
+	setTieOptions := func() {
+		// Only a tracked aperture (normally a bright star) can be followed
+		options := []string{noTie}
+		for _, a := range myWin.apertures {
+			if trackerIndex(myWin.apertures, a.Name) >= 0 {
+				options = append(options, a.Name)
+			}
+		}
+		tieSelector.Options = options
+		tieSelector.SetSelected(noTie)
+	}
+	setTieOptions()
+	pathsCheck := widget.NewCheck("Show aperture paths on the image", func(checked bool) {
+		myWin.showAperturePaths = checked
+		if myWin.imageView != nil {
+			myWin.imageView.placeTrackOverlay()
+		}
+	})
+	pathsCheck.Checked = myWin.showAperturePaths
+
+	skySelector := widget.NewSelect(skyMethods, func(opt string) {
+		myWin.skyMethod = opt
+		myWin.App.Preferences().SetString("SkyMethod", opt)
+	})
+	skySelector.Selected = myWin.skyMethod
+	gainEntry := widget.NewEntry()
+	gainEntry.SetText(strconv.FormatFloat(myWin.photometryGain, 'f', -1, 64))
+	gainEntry.OnChanged = func(text string) {
+		gain, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil || gain <= 0 {
+			return
+		}
+		myWin.photometryGain = gain
+		myWin.App.Preferences().SetFloat("PhotometryGain", gain)
+	}
+
+	addButton := widget.NewButton("Add the ROI as an aperture", func() {
+		name := strings.TrimSpace(nameEntry.Text)
+		if myWin.folderSelected == "" || len(myWin.fitsFilePaths) == 0 {
+			dialog.ShowInformation("Apertures", "Open a folder first.", apertureWin)
+			return
+		}
+		if name == "" {
+			dialog.ShowInformation("Apertures", "Give the aperture a name.", apertureWin)
+			return
+		}
+		for _, a := range myWin.apertures {
+			if a.Name == name {
+				dialog.ShowInformation("Apertures", "There is already an aperture called "+name, apertureWin)
+				return
+			}
+		}
+		a := aperture{Name: name, Role: roleSelector.Selected, Shape: shapeSelector.Selected,
+			X0: myWin.x0, Y0: myWin.y0, X1: myWin.x1, Y1: myWin.y1}
+		if a.Shape == shapeCircle {
+			// The circle fills the ROI, and the annulus is outside it
+			a.CenterX = float64(myWin.x0+myWin.x1) / 2
+			a.CenterY = float64(myWin.y0+myWin.y1) / 2
+			a.Radius = float64(min(myWin.x1-myWin.x0, myWin.y1-myWin.y0)) / 2
+			a.SkyInner = 1.5 * a.Radius
+			a.SkyOuter = 2.5 * a.Radius
+			var err1, err2 error
+			if text := strings.TrimSpace(skyInnerEntry.Text); text != "" {
+				a.SkyInner, err1 = strconv.ParseFloat(text, 64)
+			}
+			if text := strings.TrimSpace(skyOuterEntry.Text); text != "" {
+				a.SkyOuter, err2 = strconv.ParseFloat(text, 64)
+			}
+			if err1 != nil || err2 != nil || a.SkyInner < a.Radius || a.SkyOuter <= a.SkyInner {
+				dialog.ShowInformation("Apertures",
+					"The sky annulus must be outside the aperture, with its outer radius larger than its inner one.",
+					apertureWin)
+				return
+			}
+		}
+		if tieSelector.Selected != noTie && tieSelector.Selected != "" {
+			a.TiedTo = tieSelector.Selected
+		} else if trackCheck.Checked {
+			a.SearchRadius = 2 * a.size()
+			a.DriftLimit = 3
+			var err1, err2 error
+			if text := strings.TrimSpace(searchEntry.Text); text != "" {
+				a.SearchRadius, err1 = strconv.ParseFloat(text, 64)
+			}
+			if text := strings.TrimSpace(driftEntry.Text); text != "" {
+				a.DriftLimit, err2 = strconv.ParseFloat(text, 64)
+			}
+			if err1 != nil || err2 != nil || a.SearchRadius <= 0 || a.DriftLimit <= 0 {
+				dialog.ShowInformation("Apertures", "The search radius and drift limit must be positive numbers.",
+					apertureWin)
+				return
+			}
+			a.Track = true
+		}
+		myWin.apertures = append(myWin.apertures, a)
+		saveApertures()
+		nameEntry.SetText("")
+		setTieOptions()
+		apertureList.Refresh()
+	})
+	deleteButton := widget.NewButton("Delete selected aperture", func() {
+		if selected < 0 || selected >= len(myWin.apertures) {
+			return
+		}
+		myWin.apertures = append(myWin.apertures[:selected], myWin.apertures[selected+1:]...)
+		removeDanglingTies()
+		saveApertures()
+		setTieOptions()
+		apertureList.UnselectAll()
+		apertureList.Refresh()
+	})
+	measureButton := widget.NewButton("Measure apertures over the folder", func() { runApertureMeasurement(apertureWin) })
+
+	controls := container.NewVBox(
+		widget.NewLabel("Position the ROI (Draw ROI on image makes that easy), name it and add it.\n"+
+			"A circle fills the ROI. The ratio curve is the first target divided by the sum of the comparisons."),
+		container.NewBorder(nil, nil, nil, container.NewHBox(roleSelector, shapeSelector), nameEntry),
+		widget.NewForm(
+			widget.NewFormItem("Sky annulus inner radius (pixels)", skyInnerEntry),
+			widget.NewFormItem("Sky annulus outer radius (pixels)", skyOuterEntry),
+			widget.NewFormItem("Tracking", trackCheck),
+			widget.NewFormItem("Search radius (pixels)", searchEntry),
+			widget.NewFormItem("Drift limit (pixels per frame)", driftEntry),
+			widget.NewFormItem("Move with aperture", tieSelector),
+			widget.NewFormItem("Sky level", skySelector),
+			widget.NewFormItem("Gain (electrons per ADU)", gainEntry),
+		),
+		addButton,
+		deleteButton,
+		measureButton,
+		widget.NewButton("Export lightcurve csv for PyOTE...", func() { exportLightcurveCSV(apertureWin) }),
+		pathsCheck,
+	)
+	apertureWin.SetContent(container.NewBorder(nil, controls, nil, nil, apertureList))
+	apertureWin.Show()
+	apertureWin.CenterOnScreen()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Auto-contrast sets the black and white sliders to percentiles of the pixel values in a sample
+// region: the whole frame, the ROI, or a box the user draws on the image. It runs on the first frame of
+// a folder and whenever the Auto button is clicked.
+
+const autoRegionFrame = "whole frame"
+const autoRegionROI = "ROI"
+const autoRegionBox = "drawn box"
+
+func loadAutoContrastSettings() {
+	prefs := myWin.App.Preferences()
+	myWin.autoContrastRegion = prefs.StringWithFallback("AutoContrastRegion", autoRegionFrame)
+	myWin.autoBlackPercentile = prefs.FloatWithFallback("AutoContrastBlackPercentile", 1.0)
+	myWin.autoWhitePercentile = prefs.FloatWithFallback("AutoContrastWhitePercentile", 99.5)
+	myWin.autoContrastBox = image.Rect(
+		prefs.IntWithFallback("AutoContrastBoxX0", 0),
+		prefs.IntWithFallback("AutoContrastBoxY0", 0),
+		prefs.IntWithFallback("AutoContrastBoxX1", 0),
+		prefs.IntWithFallback("AutoContrastBoxY1", 0))
+}
+
+func saveAutoContrastSettings() {
+	prefs := myWin.App.Preferences()
+	prefs.SetString("AutoContrastRegion", myWin.autoContrastRegion)
+	prefs.SetFloat("AutoContrastBlackPercentile", myWin.autoBlackPercentile)
+	prefs.SetFloat("AutoContrastWhitePercentile", myWin.autoWhitePercentile)
+	prefs.SetInt("AutoContrastBoxX0", myWin.autoContrastBox.Min.X)
+	prefs.SetInt("AutoContrastBoxY0", myWin.autoContrastBox.Min.Y)
+	prefs.SetInt("AutoContrastBoxX1", myWin.autoContrastBox.Max.X)
+	prefs.SetInt("AutoContrastBoxY1", myWin.autoContrastBox.Max.Y)
+}
+
+func autoContrastRect(frame *frameData) image.Rectangle {
+	// The sample region, clipped to the frame. An empty (or entirely off frame) region falls back
+	// to the whole frame so that small images and stale boxes still get a sensible result.
+	frameRect := image.Rect(0, 0, frame.width, frame.height)
+	var rect image.Rectangle
+	switch myWin.autoContrastRegion {
+	case autoRegionROI:
+		rect = image.Rect(myWin.x0, myWin.y0, myWin.x1, myWin.y1)
+	case autoRegionBox:
+		rect = myWin.autoContrastBox
+	default:
+		rect = frameRect
+	}
+	rect = rect.Intersect(frameRect)
+	if rect.Empty() {
+		return frameRect
+	}
+	return rect
+}
+
+func percentile(sorted []float64, percent float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	k := int(math.Round(percent / 100 * float64(len(sorted)-1)))
+	return sorted[max(0, min(k, len(sorted)-1))]
+}
+
+func autoContrast(frame *frameData) {
+	rect := autoContrastRect(frame)
+	var values []float64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			value := frame.at(x, y)
+			if !math.IsNaN(value) {
+				values = append(values, value)
+			}
+		}
+	}
+	sort.Float64s(values)
+	black := percentile(values, myWin.autoBlackPercentile)
+	white := percentile(values, myWin.autoWhitePercentile)
+	if white <= black {
+		white = black + myWin.whiteSlider.Step // A flat region still needs a usable white level
+	}
+
+	// Set directly rather than with SetValue() so that OnChanged (which redisplays) is not triggered
+	myWin.blackSlider.Value = math.Max(myWin.blackSlider.Min, math.Min(myWin.blackSlider.Max, black))
+	myWin.whiteSlider.Value = math.Max(myWin.whiteSlider.Min, math.Min(myWin.whiteSlider.Max, white))
+	myWin.blackSlider.Refresh()
+	myWin.whiteSlider.Refresh()
+}
+
+func applyAutoContrast() {
+	if len(myWin.fitsImages) == 0 {
+		return
+	}
+	myWin.adjustSliders = true
+	displayFitsImage()
+}
+
+func setAutoContrastBox(rect image.Rectangle) {
+	myWin.autoContrastBox = rect
+	myWin.autoContrastRegion = autoRegionBox
+	saveAutoContrastSettings()
+	applyAutoContrast()
+}
+
+func autoContrastSettingsEntry() {
+	regionSelector := widget.NewSelect([]string{autoRegionFrame, autoRegionROI, autoRegionBox}, nil)
+	regionSelector.SetSelected(myWin.autoContrastRegion)
+	blackEntry := widget.NewEntry()
+	blackEntry.SetText(fmt.Sprintf("%g", myWin.autoBlackPercentile))
+	whiteEntry := widget.NewEntry()
+	whiteEntry.SetText(fmt.Sprintf("%g", myWin.autoWhitePercentile))
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("sample region", regionSelector),
+		widget.NewFormItem("black percentile", blackEntry),
+		widget.NewFormItem("white percentile", whiteEntry),
+	}
+	dialog.ShowForm("Auto-contrast settings", "OK", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		blackPercentile, err0 := strconv.ParseFloat(blackEntry.Text, 64)
+		whitePercentile, err1 := strconv.ParseFloat(whiteEntry.Text, 64)
+		if err0 != nil || err1 != nil {
+			dialog.ShowInformation("Oops", "A number is needed for each percentile.", myWin.parentWindow)
+			return
+		}
+		if blackPercentile < 0 || whitePercentile > 100 || blackPercentile >= whitePercentile {
+			dialog.ShowInformation("Oops",
+				"Percentiles must be from 0 to 100, with black below white.", myWin.parentWindow)
+			return
+		}
+		myWin.autoBlackPercentile = blackPercentile
+		myWin.autoWhitePercentile = whitePercentile
+		myWin.autoContrastRegion = regionSelector.Selected
+		saveAutoContrastSettings()
+
+		if myWin.autoContrastRegion == autoRegionBox {
+			// The box is drawn on the image. setAutoContrastBox() is called when the drag ends.
+			myWin.imageDragMode = dragModeAutoContrastBox
+			dialog.ShowInformation("Auto-contrast box",
+				"Drag out a box on the image to sample for auto-contrast.", myWin.parentWindow)
+			return
+		}
+		applyAutoContrast()
+	}, myWin.parentWindow)
+}
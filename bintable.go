@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A minimal reader for BINTABLE extensions (FITS standard section 7.3). The whole data unit (rows
+// and heap) is read into memory - the tables we read are timestamp lists and compressed images.
+
+type binTableColumn struct {
+	name     string
+	dataType byte // The TFORM type code (L X B I J K A E D C M P Q)
+	repeat   int
+	heapType byte // Element type for P and Q (variable length array) columns
+	offset   int  // Byte offset of the field in a row
+	width    int  // Bytes the field occupies in a row
+}
+
+type binTable struct {
+	header   *fitsHeader
+	rowBytes int
+	numRows  int
+	columns  []binTableColumn
+	rows     []byte
+	heap     []byte
+}
+
+var tformPattern = regexp.MustCompile(`^(\d*)([LXBIJKAEDCMPQ])([LXBIJKAEDCM]?)`)
+
+func binTableTypeSize(dataType byte) int {
+	switch dataType {
+	case 'L', 'B', 'A':
+		return 1
+	case 'I':
+		return 2
+	case 'J', 'E':
+		return 4
+	case 'K', 'D', 'C', 'P':
+		return 8
+	case 'M', 'Q':
+		return 16
+	}
+	return 0
+}
+
+func readBinTable(r io.Reader, header *fitsHeader) (*binTable, error) {
+	// r must be positioned at the start of the data unit. It is left at the start of the next HDU.
+	if header.stringValue("XTENSION") != "BINTABLE" {
+		return nil, fmt.Errorf("not a BINTABLE extension")
+	}
+	table := &binTable{header: header}
+	table.rowBytes = header.intValue("NAXIS1", 0)
+	table.numRows = header.intValue("NAXIS2", 0)
+
+	offset := 0
+	for i := 1; i <= header.intValue("TFIELDS", 0); i++ {
+		tform := strings.TrimSpace(header.stringValue(fmt.Sprintf("TFORM%d", i)))
+		match := tformPattern.FindStringSubmatch(tform)
+		if match == nil {
+			return nil, fmt.Errorf("cannot parse TFORM%d = '%s'", i, tform)
+		}
+		column := binTableColumn{
+			name:     strings.TrimSpace(header.stringValue(fmt.Sprintf("TTYPE%d", i))),
+			dataType: match[2][0],
+			repeat:   1,
+			offset:   offset,
+		}
+		if match[1] != "" {
+			column.repeat, _ = strconv.Atoi(match[1])
+		}
+		if match[3] != "" {
+			column.heapType = match[3][0]
+		}
+		if column.dataType == 'X' {
+			column.width = (column.repeat + 7) / 8
+		} else {
+			column.width = column.repeat * binTableTypeSize(column.dataType)
+		}
+		offset += column.width
+		table.columns = append(table.columns, column)
+	}
+	if offset != table.rowBytes {
+		return nil, fmt.Errorf("TFORM fields add up to %d bytes but NAXIS1 is %d", offset, table.rowBytes)
+	}
+
+	data := make([]byte, header.paddedDataBytes())
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("reading BINTABLE data: %w", err)
+	}
+	mainBytes := table.rowBytes * table.numRows
+	table.rows = data[:mainBytes]
+	heapEnd := int(header.dataBytes())
+	heapStart := min(header.intValue("THEAP", mainBytes), heapEnd)
+	table.heap = data[heapStart:heapEnd]
+	return table, nil
+}
+
+func (t *binTable) column(name string) (binTableColumn, bool) {
+	for _, column := range t.columns {
+		if strings.EqualFold(column.name, name) {
+			return column, true
+		}
+	}
+	return binTableColumn{}, false
+}
+
+func (t *binTable) field(row int, column binTableColumn) []byte {
+	start := row*t.rowBytes + column.offset
+	return t.rows[start : start+column.width]
+}
+
+func (t *binTable) stringValue(row int, column binTableColumn) string {
+	return strings.TrimRight(string(t.field(row, column)), " \x00")
+}
+
+func (t *binTable) floatValue(row int, column binTableColumn) float64 {
+	// The first element of a numeric field
+	b := t.field(row, column)
+	switch column.dataType {
+	case 'B':
+		return float64(b[0])
+	case 'I':
+		return float64(int16(binary.BigEndian.Uint16(b)))
+	case 'J':
+		return float64(int32(binary.BigEndian.Uint32(b)))
+	case 'K':
+		return float64(int64(binary.BigEndian.Uint64(b)))
+	case 'E':
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 'D':
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return math.NaN()
+}
+
+func (t *binTable) heapArray(row int, column binTableColumn) ([]byte, error) {
+	// The bytes of a variable length array (P or Q column) in the heap
+	b := t.field(row, column)
+	var count, offset int64
+	if column.dataType == 'P' {
+		count = int64(binary.BigEndian.Uint32(b[0:4]))
+		offset = int64(binary.BigEndian.Uint32(b[4:8]))
+	} else {
+		count = int64(binary.BigEndian.Uint64(b[0:8]))
+		offset = int64(binary.BigEndian.Uint64(b[8:16]))
+	}
+	numBytes := count * int64(binTableTypeSize(column.heapType))
+	if offset < 0 || offset+numBytes > int64(len(t.heap)) {
+		return nil, fmt.Errorf("heap array of row %d of column %s is outside the heap", row+1, column.name)
+	}
+	return t.heap[offset : offset+numBytes], nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Master bias/dark and flat frames. When they are loaded, every frame is calibrated as it is read:
+// (frame - dark) / flat, with each plane of the flat scaled to a median of 1. The display, the ROI
+// statistics and the lightcurve all work from the decoded frame, so all of them see calibrated
+// pixels. A master can be read from a FITS file or built by median-combining a folder of frames.
+
+const maxCombineFrames = 50 // Calibration frames held in memory while a folder is combined
+
+type masterFrame struct {
+	frame  *frameData
+	source string // The file read or the folder combined - for the log
+}
+
+func calibrateFrame(frame *frameData) *frameData {
+	// Returns frame itself when there is nothing (of the right size) to calibrate with
+	return calibrateWith(frame, myWin.masterDark, myWin.masterFlat)
+}
+
+func calibrateWith(frame *frameData, dark, flat *masterFrame) *frameData {
+	if dark != nil && (dark.frame.width != frame.width || dark.frame.height != frame.height) {
+		dark = nil
+	}
+	if flat != nil && (flat.frame.width != frame.width || flat.frame.height != frame.height) {
+		flat = nil
+	}
+	if dark == nil && flat == nil {
+		return frame
+	}
+
+	// A new frame is made - the planes of frame may be shared with the cache or with each other
+	calibrated := *frame
+	calibrated.raw = frame // For the pixel readout, which shows the raw ADU as well
+	if frame.isColor() {
+		calibrated.red = calibratePlane(frame.red, masterPlane(dark, channelRed), masterPlane(flat, channelRed))
+		calibrated.green = calibratePlane(frame.green, masterPlane(dark, channelGreen), masterPlane(flat, channelGreen))
+		calibrated.blue = calibratePlane(frame.blue, masterPlane(dark, channelBlue), masterPlane(flat, channelBlue))
+		calibrated.pix = measurementChannel(calibrated.red, calibrated.green, calibrated.blue)
+	} else {
+		calibrated.pix = calibratePlane(frame.pix, masterPlane(dark, ""), masterPlane(flat, ""))
+	}
+	return &calibrated
+}
+
+func masterPlane(master *masterFrame, channel string) []float64 {
+	// The plane of a master that goes with a plane of a frame. A mono master serves every plane.
+	if master == nil {
+		return nil
+	}
+	if master.frame.isColor() {
+		switch channel {
+		case channelRed:
+			return master.frame.red
+		case channelGreen:
+			return master.frame.green
+		case channelBlue:
+			return master.frame.blue
+		}
+	}
+	return master.frame.pix
+}
+
+func calibratePlane(plane, dark, flat []float64) []float64 {
+	out := make([]float64, len(plane))
+	for i, value := range plane {
+		if dark != nil {
+			value -= dark[i]
+		}
+		if flat != nil {
+			if flat[i] > 0 {
+				value /= flat[i]
+			} else {
+				value = math.NaN() // A dead (or invalid) flat pixel cannot be corrected
+			}
+		}
+		out[i] = value
+	}
+	return out
+}
+
+func median(values []float64) float64 {
+	// values is sorted in place. NaN for an empty slice.
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	slices.Sort(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+func normalizedPlane(plane []float64) []float64 {
+	// plane divided by the median of its valid pixels
+	var valid []float64
+	for _, value := range plane {
+		if !math.IsNaN(value) {
+			valid = append(valid, value)
+		}
+	}
+	scale := median(valid)
+	out := make([]float64, len(plane))
+	for i, value := range plane {
+		out[i] = value / scale
+	}
+	return out
+}
+
+func normalizeFlat(frame *frameData) *frameData {
+	flat := *frame
+	flat.raw = nil
+	flat.pix = normalizedPlane(frame.pix)
+	if frame.isColor() {
+		flat.red = normalizedPlane(frame.red)
+		flat.green = normalizedPlane(frame.green)
+		flat.blue = normalizedPlane(frame.blue)
+	}
+	return &flat
+}
+
+func folderFitsPaths(folder string) ([]string, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && (strings.HasSuffix(name, ".fits") || strings.HasSuffix(name, ".fits.fz")) {
+			paths = append(paths, filepath.Join(folder, name))
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no FITS files were found in %s", folder)
+	}
+	return paths, nil
+}
+
+func medianCombineFolder(folder string, dark *masterFrame) (*frameData, int, error) {
+	// Median of the frames in folder, pixel by pixel (and plane by plane for color frames). dark,
+	// when not nil, is subtracted from every frame first (flats need that; darks do not get one).
+	paths, err := folderFitsPaths(folder)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(paths) > maxCombineFrames {
+		log.Printf("only the first %d of the %d frames in %s are combined\n", maxCombineFrames, len(paths), folder)
+		paths = paths[:maxCombineFrames]
+	}
+
+	var first *frameData
+	var stacks [][][]float32 // [plane][frame][pixel] - float32 to halve the memory needed
+	for _, path := range paths {
+		frame, _, _, err := readFrameFile(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		frame = calibrateWith(frame, dark, nil)
+		planes := [][]float64{frame.pix}
+		if frame.isColor() {
+			planes = [][]float64{frame.red, frame.green, frame.blue}
+		}
+		if first == nil {
+			first = frame
+			stacks = make([][][]float32, len(planes))
+		}
+		if frame.width != first.width || frame.height != first.height || len(planes) != len(stacks) {
+			return nil, 0, fmt.Errorf("%s is not the same size and type as %s", path, paths[0])
+		}
+		for p, plane := range planes {
+			stacked := make([]float32, len(plane))
+			for i, value := range plane {
+				stacked[i] = float32(value)
+			}
+			stacks[p] = append(stacks[p], stacked)
+		}
+	}
+
+	master := *first
+	master.raw = nil // A master only needs its own pixels
+	combined := make([][]float64, len(stacks))
+	for p := range stacks {
+		combined[p] = medianStack(stacks[p])
+	}
+	if len(combined) == 3 {
+		master.red, master.green, master.blue = combined[0], combined[1], combined[2]
+		master.pix = measurementChannel(master.red, master.green, master.blue)
+	} else {
+		master.pix = combined[0]
+	}
+	return &master, len(paths), nil
+}
+
+func medianStack(stack [][]float32) []float64 {
+	// The pixels are split between as many goroutines as there are CPUs
+	numPixels := len(stack[0])
+	out := make([]float64, numPixels)
+	chunk := (numPixels + runtime.NumCPU() - 1) / runtime.NumCPU()
+	var wg sync.WaitGroup
+	for start := 0; start < numPixels; start += chunk {
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			values := make([]float64, 0, len(stack))
+			for i := start; i < end; i++ {
+				values = values[:0]
+				for _, plane := range stack {
+					if value := float64(plane[i]); !math.IsNaN(value) {
+						values = append(values, value)
+					}
+				}
+				out[i] = median(values)
+			}
+		}(start, min(start+chunk, numPixels))
+	}
+	wg.Wait()
+	return out
+}
+
+func calibrationDescription() string {
+	// For the log file (and anything else that reports how the pixels were measured)
+	text := "calibration: "
+	if myWin.masterDark == nil && myWin.masterFlat == nil {
+		return text + "none"
+	}
+	if myWin.masterDark != nil {
+		text += "dark/bias = " + myWin.masterDark.source
+	}
+	if myWin.masterFlat != nil {
+		if myWin.masterDark != nil {
+			text += "  "
+		}
+		text += "flat = " + myWin.masterFlat.source
+	}
+	return text
+}
+
+func calibrationChanged() {
+	log.Println(calibrationDescription())
+	myWin.frameCache.clear() // The cached frames were calibrated with the old masters
+	if len(myWin.fitsImages) > 0 {
+		displayFitsImage()
+	}
+}
+
+func setMaster(isFlat bool, frame *frameData, source string, statusLabel *widget.Label, win fyne.Window) {
+	if isFlat {
+		myWin.masterFlat = &masterFrame{frame: normalizeFlat(frame), source: source}
+	} else {
+		myWin.masterDark = &masterFrame{frame: frame, source: source}
+	}
+	if myWin.frame != nil && (frame.width != myWin.frame.width || frame.height != myWin.frame.height) {
+		dialog.ShowInformation("Calibration",
+			fmt.Sprintf("The master is %dx%d but the frames are %dx%d.\nIt will not be applied to them.",
+				frame.width, frame.height, myWin.frame.width, myWin.frame.height), win)
+	}
+	statusLabel.SetText(calibrationDescription())
+	calibrationChanged()
+}
+
+func loadMasterFile(isFlat bool, statusLabel *widget.Label, win fyne.Window) {
+	fileOpen := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+		if err != nil || reader == nil {
+			return
+		}
+		path := reader.URI().Path()
+		_ = reader.Close()
+		frame, _, _, err := readFrameFile(path)
+		if err != nil {
+			dialog.ShowInformation("Calibration", err.Error(), win)
+			return
+		}
+		setMaster(isFlat, frame, path, statusLabel, win)
+	}, win)
+	fileOpen.SetFilter(storage.NewExtensionFileFilter([]string{".fits", ".fz"}))
+	fileOpen.Resize(fyne.Size{Width: 800, Height: 600})
+	fileOpen.Show()
+}
+
+func combineMasterFolder(isFlat bool, statusLabel *widget.Label, win fyne.Window) {
+	folderOpen := dialog.NewFolderOpen(func(uri fyne.ListableURI, err error) {
+		if err != nil || uri == nil {
+			return
+		}
+		folder := uri.Path()
+		busy := dialog.NewCustomWithoutButtons("Median-combining "+filepath.Base(folder),
+			widget.NewProgressBarInfinite(), win)
+		busy.Show()
+		go func() {
+			var dark *masterFrame
+			if isFlat {
+				dark = myWin.masterDark
+			}
+			frame, numFrames, err := medianCombineFolder(folder, dark)
+			busy.Hide()
+			if err != nil {
+				dialog.ShowInformation("Calibration", err.Error(), win)
+				return
+			}
+			setMaster(isFlat, frame, fmt.Sprintf("median of %d frames in %s", numFrames, folder), statusLabel, win)
+		}()
+	}, win)
+	folderOpen.Resize(fyne.Size{Width: 800, Height: 600})
+	folderOpen.Show()
+}
+
+func showCalibrationWindow() {
+	trace("")
+	calWin := myWin.App.NewWindow("Dark and flat calibration")
+	calWin.Resize(fyne.Size{Height: 400, Width: 700})
+
+	statusLabel := widget.NewLabel(calibrationDescription())
+	statusLabel.Wrapping = fyne.TextWrapWord
+
+	content := container.NewVBox(
+		widget.NewLabel("Frames are calibrated as (frame - dark) / flat. A master that is not the size of\n"+
+			"the frames is ignored. A dark loaded before a flat folder is combined is subtracted\n"+
+			"from the flat frames, so load a bias (or a dark of the flat exposure) for that."),
+		widget.NewButton("Load master dark/bias...", func() { loadMasterFile(false, statusLabel, calWin) }),
+		widget.NewButton("Combine a folder of darks/biases...", func() { combineMasterFolder(false, statusLabel, calWin) }),
+		widget.NewButton("Clear dark/bias", func() {
+			myWin.masterDark = nil
+			statusLabel.SetText(calibrationDescription())
+			calibrationChanged()
+		}),
+		widget.NewButton("Load master flat...", func() { loadMasterFile(true, statusLabel, calWin) }),
+		widget.NewButton("Combine a folder of flats...", func() { combineMasterFolder(true, statusLabel, calWin) }),
+		widget.NewButton("Clear flat", func() {
+			myWin.masterFlat = nil
+			statusLabel.SetText(calibrationDescription())
+			calibrationChanged()
+		}),
+		statusLabel,
+	)
+	calWin.SetContent(content)
+	calWin.Show()
+	calWin.CenterOnScreen()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// A clock step is a jump in the PC clock (Windows time sync or NTP) that happened while SharpCap
+// was recording. It shows up as a single anomalous frame-to-frame delta in myWin.sysStartTimes, just
+// like a dropped frame gap does, but no frames are missing, so no placeholders must be inserted for it.
+
+func isCadenceError(i int) bool {
+	// A late (or early) timestamp on a single frame produces a pair of adjacent bad deltas that
+	// compensate each other: one too long, the next one too short (or vice versa). A clock step
+	// or a dropped frame gap produces a single bad delta.
+	deltas := myWin.sysTimeDeltaSeconds
+	pairLow := myWin.frameTimeSeconds * 1.8
+	pairHigh := myWin.frameTimeSeconds * 2.2
+	if i+1 < len(deltas) && !isGoodFrame(deltas[i+1]) {
+		pairSum := deltas[i] + deltas[i+1]
+		if pairSum >= pairLow && pairSum <= pairHigh {
+			return true
+		}
+	}
+	if i > 0 && !isGoodFrame(deltas[i-1]) {
+		pairSum := deltas[i-1] + deltas[i]
+		if pairSum >= pairLow && pairSum <= pairHigh {
+			return true
+		}
+	}
+	return false
+}
+
+func isClockStep(i int) bool {
+	// Gaps that the flash spacing cross-check has shown to be clock steps are always treated as such.
+	if myWin.forcedClockSteps[i] {
+		return true
+	}
+	delta := myWin.sysTimeDeltaSeconds[i]
+	if !isDroppedFrame(delta) {
+		// A delta that is too short (or negative) cannot be explained by missing frames.
+		return true
+	}
+	// Dropped frames leave a gap that is a whole number of frame times long (within the same
+	// tolerance we allow for a good frame). Anything else is the clock jumping.
+	numFrameTimes := math.Round(delta / myWin.frameTimeSeconds)
+	residual := math.Abs(delta - numFrameTimes*myWin.frameTimeSeconds)
+	return residual > myWin.frameTimeSeconds*0.2
+}
+
+func recordClockStep(i int) {
+	// We assume no frame was lost at the moment the clock stepped, so everything beyond one frame
+	// time is the size of the step.
+	stepSeconds := myWin.sysTimeDeltaSeconds[i] - myWin.frameTimeSeconds
+	myWin.clockStepIndices = append(myWin.clockStepIndices, i)
+	myWin.clockStepSeconds = append(myWin.clockStepSeconds, stepSeconds)
+	log.Printf("clock step of %0.6f seconds found between readings %d and %d\n", stepSeconds, i, i+1)
+}
+
+func totalClockStepSeconds() float64 {
+	total := 0.0
+	for _, step := range myWin.clockStepSeconds {
+		total += step
+	}
+	return total
+}
+
+func edgeTimeFilePath(folder string) string {
+	if strings.HasSuffix(folder, "\\") {
+		return folder + edgeTimesFileName
+	}
+	return folder + "\\" + edgeTimesFileName
+}
+
+func crossCheckGapsAgainstFlashSpacing() bool {
+	// The flashes are placed at GPS accurate times, so the number of frames between the two goalpost
+	// edges is known independently of the PC clock. If the dropped frame insertion put more frames
+	// between the goalposts than that, one or more of the 'gaps' was really a forward clock step.
+	// Returns true when gaps were reclassified as clock steps (the caller must then redo the dropped
+	// frame insertion and edge detection).
+	if myWin.leftGoalpostStats == nil || myWin.rightGoalpostStats == nil || len(myWin.gapIndices) == 0 {
+		return false
+	}
+	if !pathExists(edgeTimeFilePath(myWin.cmdLineFolder)) {
+		log.Println("No edge time file - gaps cannot be cross-checked against flash spacing")
+		return false
+	}
+	readEdgeTimeFile(myWin.cmdLineFolder)
+
+	leftFlashTime, err := time.Parse(time.RFC3339, myWin.leftGoalpostTimestamp)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	rightFlashTime, err := time.Parse(time.RFC3339, myWin.rightGoalpostTimestamp)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	readingsBetweenGoalposts := myWin.rightGoalpostStats.edgeAt - myWin.leftGoalpostStats.edgeAt
+	expectedReadings := rightFlashTime.Sub(leftFlashTime).Seconds() / myWin.frameTimeSeconds
+	surplus := int(math.Round(readingsBetweenGoalposts - expectedReadings))
+	log.Printf("\nflash spacing cross-check: %0.2f readings between goalposts, %0.2f expected\n",
+		readingsBetweenGoalposts, expectedReadings)
+
+	if surplus < 0 {
+		log.Printf("%d frames are missing between the goalposts that were not detected as dropped\n", -surplus)
+		return false
+	}
+	if surplus == 0 {
+		return false
+	}
+
+	// Find the gaps that lie between the goalposts (in lightcurve coordinates, which include the inserted frames)
+	var gapsBetweenGoalposts []int
+	framesInsertedBefore := 0
+	for k, gapIndex := range myWin.gapIndices {
+		position := float64(gapIndex + framesInsertedBefore)
+		if position >= myWin.leftGoalpostStats.edgeAt && position < myWin.rightGoalpostStats.edgeAt {
+			gapsBetweenGoalposts = append(gapsBetweenGoalposts, k)
+		}
+		framesInsertedBefore += myWin.gapWidth[k]
+	}
+
+	// Prefer a single gap that exactly accounts for the surplus, otherwise all of them must.
+	for _, k := range gapsBetweenGoalposts {
+		if myWin.gapWidth[k] == surplus {
+			myWin.forcedClockSteps[myWin.gapIndices[k]] = true
+			return true
+		}
+	}
+	totalInserted := 0
+	for _, k := range gapsBetweenGoalposts {
+		totalInserted += myWin.gapWidth[k]
+	}
+	if totalInserted == surplus {
+		for _, k := range gapsBetweenGoalposts {
+			myWin.forcedClockSteps[myWin.gapIndices[k]] = true
+		}
+		return true
+	}
+
+	log.Printf("%d surplus frames between goalposts could not be matched to dropped frame gaps\n", surplus)
+	return false
+}
+
+func redoDroppedFrameInsertion() {
+	// Restore the frame list and lightcurve as read from the folder, then run the dropped frame
+	// analysis again (myWin.forcedClockSteps now marks the gaps that are clock steps).
+	myWin.fitsFilePaths = make([]string, len(myWin.scannedFitsFilePaths))
+	copy(myWin.fitsFilePaths, myWin.scannedFitsFilePaths)
+	myWin.lightcurve = make([]float64, len(myWin.scannedLightcurve))
+	copy(myWin.lightcurve, myWin.scannedLightcurve)
+	myWin.numDroppedFrames = analyzeTimeStepsAndImproveFrameTimeEstimate(true)
+}
+
+func clockStepReport() string {
+	if len(myWin.clockStepIndices) == 0 {
+		return ""
+	}
+	report := fmt.Sprintf("The PC clock stepped %d time(s) during the recording:\n\n", len(myWin.clockStepIndices))
+	for k, i := range myWin.clockStepIndices {
+		report += fmt.Sprintf("    %+0.3f ms between readings %d and %d\n", myWin.clockStepSeconds[k]*1000, i, i+1)
+	}
+	report += "\nThese were not treated as dropped frames."
+	return report
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// Color frames come either as RGB cubes (NAXIS3 = 3) or as raw Bayer mosaics with a BAYERPAT (or
+// COLORTYP) card. Both are shown in color. The flash lightcurve and photometry measure a single
+// value per pixel: luminance, or one channel picked from the Options menu.
+
+const channelLuminance = "luminance"
+const channelRed = "red"
+const channelGreen = "green"
+const channelBlue = "blue"
+
+var colorChannels = []string{channelLuminance, channelRed, channelGreen, channelBlue}
+
+func bayerPattern(bayerPat, colorTyp string, xOffset, yOffset int) string {
+	// Returns the pattern as seen from pixel (0,0), or "" if the frame is not a Bayer mosaic.
+	// An odd XBAYROFF/YBAYROFF means the mosaic starts one column/row into the pattern.
+	pattern := strings.ToUpper(bayerPat)
+	if pattern == "" {
+		pattern = strings.ToUpper(colorTyp)
+	}
+	switch pattern {
+	case "RGGB", "BGGR", "GRBG", "GBRG":
+	default:
+		return ""
+	}
+	if xOffset%2 != 0 {
+		pattern = string([]byte{pattern[1], pattern[0], pattern[3], pattern[2]})
+	}
+	if yOffset%2 != 0 {
+		pattern = pattern[2:] + pattern[:2]
+	}
+	return pattern
+}
+
+func debayer(mosaic []float64, width, height int, pattern string) (red, green, blue []float64) {
+	// Bilinear: each missing color at a pixel is the average of the neighbours (in the 3x3 box
+	// around it) that have that color. Invalid (NaN) neighbours are left out.
+	colorAt := func(x, y int) byte {
+		return pattern[(y%2)*2+x%2]
+	}
+	planes := map[byte][]float64{
+		'R': make([]float64, len(mosaic)),
+		'G': make([]float64, len(mosaic)),
+		'B': make([]float64, len(mosaic)),
+	}
+	for y := range height {
+		for x := range width {
+			k := y*width + x
+			own := colorAt(x, y)
+			planes[own][k] = mosaic[k]
+			for _, c := range []byte{'R', 'G', 'B'} {
+				if c == own {
+					continue
+				}
+				sum := 0.0
+				n := 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := x+dx, y+dy
+						if nx < 0 || ny < 0 || nx >= width || ny >= height || colorAt(nx, ny) != c {
+							continue
+						}
+						value := mosaic[ny*width+nx]
+						if !math.IsNaN(value) {
+							sum += value
+							n += 1
+						}
+					}
+				}
+				if n == 0 {
+					planes[c][k] = math.NaN()
+				} else {
+					planes[c][k] = sum / float64(n)
+				}
+			}
+		}
+	}
+	return planes['R'], planes['G'], planes['B']
+}
+
+func measurementChannel(red, green, blue []float64) []float64 {
+	switch myWin.colorChannel {
+	case channelRed:
+		return red
+	case channelGreen:
+		return green
+	case channelBlue:
+		return blue
+	}
+	// Luminance with the Rec. 709 weights. NaN in any plane gives NaN.
+	pix := make([]float64, len(red))
+	for i := range pix {
+		pix[i] = 0.2126*red[i] + 0.7152*green[i] + 0.0722*blue[i]
+	}
+	return pix
+}
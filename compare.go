@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frame comparison in the viewer. The difference display modes subtract the pinned reference frame
+// (or the previous frame) from the current one and show the signed result with a diverging stretch.
+// The blink comparator alternates between frames A and B at myWin.blinkRate: two frames of this
+// folder, or the current frame and the frame at the same position in a second folder.
+
+const displayDiffReference = "difference from reference"
+const displayDiffPrevious = "difference from previous"
+
+func differenceFrame(frame *frameData) *frameData {
+	// frame minus the reference (or previous) frame - frame itself when there is nothing to subtract
+	otherPath := ""
+	switch myWin.displayMode {
+	case displayDiffReference:
+		otherPath = myWin.referencePath
+	case displayDiffPrevious:
+		for k := myWin.fileIndex - 1; k >= 0; k-- {
+			if myWin.fitsFilePaths[k] != droppedFrameString {
+				otherPath = myWin.fitsFilePaths[k]
+				break
+			}
+		}
+	}
+	if otherPath == "" {
+		return frame
+	}
+	entry, _, err := myWin.frameCache.get(otherPath)
+	if err != nil || !sameLayout(entry.frame, frame) {
+		return frame
+	}
+
+	diff := *frame
+	var planes [4][]float64
+	otherPlanes := framePlanes(entry.frame)
+	for p, plane := range framePlanes(frame) {
+		if plane == nil {
+			continue
+		}
+		out := make([]float64, len(plane))
+		for i, value := range plane {
+			out[i] = value - otherPlanes[p][i] // NaN in either gives NaN
+		}
+		planes[p] = out
+	}
+	diff.pix, diff.red, diff.green, diff.blue = planes[0], planes[1], planes[2], planes[3]
+	diff.signed = true
+	return &diff
+}
+
+func applyDivergingStretch(frame *frameData, stretched []byte) {
+	// Zero is white, positive differences shade to red and negative ones to blue. Full color is at the
+	// 99.5th percentile of |difference| (within the ROI when one is applied), so the contrast sliders
+	// are not needed. A color difference is shown by its measurement channel.
+	var magnitudes []float64
+	for _, value := range statsRegionPixels(frame.pix) {
+		if !math.IsNaN(value) {
+			magnitudes = append(magnitudes, math.Abs(value))
+		}
+	}
+	slices.Sort(magnitudes)
+	limit := percentile(magnitudes, 99.5)
+	if limit <= 0 {
+		limit = 1
+	}
+
+	for i, value := range frame.pix {
+		if math.IsNaN(value) {
+			copy(stretched[4*i:4*i+4], []byte{invalidPixelColor.R, invalidPixelColor.G, invalidPixelColor.B, 255})
+			continue
+		}
+		t := max(-1, min(1, value/limit))
+		shade := byte(math.Round(255 * (1 - math.Abs(t))))
+		if t >= 0 {
+			copy(stretched[4*i:4*i+4], []byte{255, shade, shade, 255})
+		} else {
+			copy(stretched[4*i:4*i+4], []byte{shade, shade, 255, 255})
+		}
+	}
+}
+
+func loadBlinkSettings() {
+	myWin.blinkRate = myWin.App.Preferences().FloatWithFallback("BlinkRate", 2.0)
+}
+
+func fileOrdinal(index int) int {
+	// The position of frame index among the files of the folder: myWin.fitsFilePaths also has an entry
+	// for every dropped frame, which folder B (a plain directory listing) does not. A dropped frame
+	// gets the position of the file before it.
+	k := -1
+	for _, path := range myWin.fitsFilePaths[:index+1] {
+		if path != droppedFrameString {
+			k += 1
+		}
+	}
+	return max(k, 0)
+}
+
+func blinkPaths() (pathA, pathB string, err error) {
+	if myWin.blinkFolderB != "" {
+		if len(myWin.blinkFolderBPaths) == 0 || len(myWin.fitsFilePaths) == 0 {
+			return "", "", fmt.Errorf("there are no frames to blink")
+		}
+		pathA = myWin.fitsFilePaths[myWin.fileIndex]
+		k := fileOrdinal(myWin.fileIndex)
+		if k >= len(myWin.blinkFolderBPaths) {
+			return "", "", fmt.Errorf("folder B has only %d files - there is no file %d to blink against",
+				len(myWin.blinkFolderBPaths), k+1)
+		}
+		return pathA, myWin.blinkFolderBPaths[k], nil
+	}
+	if myWin.blinkIndexA < 0 || myWin.blinkIndexB < 0 ||
+		max(myWin.blinkIndexA, myWin.blinkIndexB) >= len(myWin.fitsFilePaths) {
+		return "", "", fmt.Errorf("set blink frames A and B (or choose a folder B) first")
+	}
+	return myWin.fitsFilePaths[myWin.blinkIndexA], myWin.fitsFilePaths[myWin.blinkIndexB], nil
+}
+
+func runBlink() {
+	showB := false
+	for myWin.blinking {
+		pathA, pathB, err := blinkPaths()
+		if err != nil {
+			myWin.blinking = false
+			dialog.ShowInformation("Blink", err.Error(), myWin.parentWindow)
+			break
+		}
+		path, name := pathA, "A"
+		if showB {
+			path, name = pathB, "B"
+		}
+		if path != droppedFrameString {
+			entry, _, err := myWin.frameCache.get(path)
+			if err == nil {
+				myWin.fileLabel.SetText(fmt.Sprintf("blink %s: %s", name, path))
+				myWin.timestampLabel.Text = entry.timestamp
+				showFrame(entry.frame)
+			}
+		}
+		showB = !showB
+		time.Sleep(time.Duration(float64(time.Second) / myWin.blinkRate))
+	}
+	if len(myWin.fitsImages) > 0 {
+		displayFitsImage() // Back to the current frame
+	}
+}
+
+func frameDescription(index int) string {
+	if index < 0 || index >= len(myWin.fitsFilePaths) {
+		return "not set"
+	}
+	return fmt.Sprintf("frame %d (%s)", index, filepath.Base(myWin.fitsFilePaths[index]))
+}
+
+func showCompareWindow() {
+	trace("")
+	compareWin := myWin.App.NewWindow("Compare frames")
+	compareWin.Resize(fyne.Size{Height: 450, Width: 600})
+
+	referenceLabel := widget.NewLabel("")
+	blinkLabel := widget.NewLabel("")
+	folderLabel := widget.NewLabel("")
+	updateLabels := func() {
+		if myWin.referencePath == "" {
+			referenceLabel.SetText("Reference: none pinned")
+		} else {
+			referenceLabel.SetText("Reference: " + filepath.Base(myWin.referencePath))
+		}
+		blinkLabel.SetText(fmt.Sprintf("Blink A: %s\nBlink B: %s",
+			frameDescription(myWin.blinkIndexA), frameDescription(myWin.blinkIndexB)))
+		if myWin.blinkFolderB == "" {
+			folderLabel.SetText("Folder B: none (A and B are frames of this folder)")
+		} else {
+			folderLabel.SetText(fmt.Sprintf("Folder B: %s (%d files) - the current frame blinks against the file at the same position in folder B (the n-th file against the n-th file, dropped frames do not count)",
+				myWin.blinkFolderB, len(myWin.blinkFolderBPaths)))
+		}
+	}
+	updateLabels()
+	folderLabel.Wrapping = fyne.TextWrapWord
+
+	currentFrameValid := func() bool {
+		if len(myWin.fitsFilePaths) == 0 || myWin.fitsFilePaths[myWin.fileIndex] == droppedFrameString {
+			dialog.ShowInformation("Compare frames", "The current frame cannot be used.", compareWin)
+			return false
+		}
+		return true
+	}
+
+	pinButton := widget.NewButton("Pin current frame as reference", func() {
+		if !currentFrameValid() {
+			return
+		}
+		myWin.referencePath = myWin.fitsFilePaths[myWin.fileIndex]
+		updateLabels()
+		if myWin.displayMode == displayDiffReference {
+			displayFitsImage()
+		}
+	})
+	setAButton := widget.NewButton("Set blink A to current frame", func() {
+		if currentFrameValid() {
+			myWin.blinkIndexA = myWin.fileIndex
+			updateLabels()
+		}
+	})
+	setBButton := widget.NewButton("Set blink B to current frame", func() {
+		if currentFrameValid() {
+			myWin.blinkIndexB = myWin.fileIndex
+			updateLabels()
+		}
+	})
+	folderButton := widget.NewButton("Choose folder B...", func() {
+		folderOpen := dialog.NewFolderOpen(func(uri fyne.ListableURI, err error) {
+			if err != nil || uri == nil {
+				return
+			}
+			paths, err := folderFitsPaths(uri.Path())
+			if err != nil {
+				dialog.ShowInformation("Compare frames", err.Error(), compareWin)
+				return
+			}
+			myWin.blinkFolderB = uri.Path()
+			myWin.blinkFolderBPaths = paths
+			updateLabels()
+		}, compareWin)
+		folderOpen.Resize(fyne.Size{Width: 800, Height: 600})
+		folderOpen.Show()
+	})
+	clearFolderButton := widget.NewButton("Clear folder B", func() {
+		myWin.blinkFolderB = ""
+		myWin.blinkFolderBPaths = nil
+		updateLabels()
+	})
+
+	rateEntry := widget.NewEntry()
+	rateEntry.SetText(strconv.FormatFloat(myWin.blinkRate, 'f', -1, 64))
+	rateEntry.OnChanged = func(text string) {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil || rate < 0.2 || rate > 30 {
+			return
+		}
+		myWin.blinkRate = rate
+		myWin.App.Preferences().SetFloat("BlinkRate", myWin.blinkRate)
+	}
+
+	blinkButton := widget.NewButton("Start blink", nil)
+	if myWin.blinking {
+		blinkButton.SetText("Stop blink")
+	}
+	blinkButton.OnTapped = func() {
+		if myWin.blinking {
+			myWin.blinking = false
+			blinkButton.SetText("Start blink")
+			return
+		}
+		if _, _, err := blinkPaths(); err != nil {
+			dialog.ShowInformation("Blink", err.Error(), compareWin)
+			return
+		}
+		myWin.autoPlayEnabled = false
+		myWin.blinking = true
+		blinkButton.SetText("Stop blink")
+		go runBlink()
+	}
+
+	content := container.NewVBox(
+		widget.NewLabel("Difference modes are chosen with the display mode selector in the main window."),
+		pinButton,
+		referenceLabel,
+		widget.NewSeparator(),
+		setAButton,
+		setBButton,
+		blinkLabel,
+		container.NewHBox(folderButton, clearFolderButton),
+		folderLabel,
+		container.NewBorder(nil, nil, widget.NewLabel("Blink rate (frames per second, 0.2 to 30):"), nil, rateEntry),
+		blinkButton,
+	)
+	compareWin.SetContent(content)
+	compareWin.Show()
+	compareWin.CenterOnScreen()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Some capture programs write a whole recording as one FITS cube (NAXIS = 3, NAXIS3 = number of frames)
+// with the frame times in a BINTABLE extension. Such a cube is opened as a sequence of frames: each
+// plane gets an entry in myWin.fitsFilePaths of the form file.fits[*,*,n] (the cfitsio image section
+// syntax, n counting from 1) and is read on its own, straight from its offset in the file.
+
+type cubeTiming struct {
+	startTimes []time.Time
+	endTimes   []time.Time
+}
+
+var cubePlanePattern = regexp.MustCompile(`^(.*)\[\*,\*,(\d+)\]$`)
+
+// The timestamp table columns we know about, in order of preference
+var cubeStartTimeColumns = []string{"DATE-OBS", "TIMESTAMP", "MJD", "MJD-OBS", "JD"}
+
+func isCube(header *fitsHeader) bool {
+	// NAXIS3 = 3 is an RGB image (see color.go), not a three frame recording
+	axes := header.axes()
+	return len(axes) == 3 && axes[2] > 1 && axes[2] != 3
+}
+
+func cubePlaneRef(path string, plane int) string {
+	return fmt.Sprintf("%s[*,*,%d]", path, plane+1)
+}
+
+func parseCubePlaneRef(ref string) (path string, plane int, ok bool) {
+	// plane counts from 0
+	match := cubePlanePattern.FindStringSubmatch(ref)
+	if match == nil {
+		return ref, 0, false
+	}
+	n, err := strconv.Atoi(match[2])
+	if err != nil || n < 1 {
+		return ref, 0, false
+	}
+	return match[1], n - 1, true
+}
+
+func expandCubes(paths []string) []string {
+	// Replaces every cube in paths by the references to its planes
+	// The map is built before it is handed over as the prefetcher reads it from another goroutine
+	timings := map[string]cubeTiming{}
+	var expanded []string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			expanded = append(expanded, path)
+			continue
+		}
+		header, err := readFitsHeader(f)
+		f.Close()
+		if err != nil || !isCube(header) {
+			expanded = append(expanded, path)
+			continue
+		}
+
+		numPlanes := header.axes()[2]
+		timing, err := readCubeTiming(path, numPlanes, header.floatValue("EXPTIME", 0.0))
+		if err != nil {
+			log.Printf("%s: %s\n", path, err)
+		}
+		timings[path] = timing
+		for plane := range numPlanes {
+			expanded = append(expanded, cubePlaneRef(path, plane))
+		}
+		log.Printf("%s is a cube of %d frames\n", path, numPlanes)
+	}
+	myWin.cubeTimings = timings
+	return expanded
+}
+
+func parseTableTime(column binTableColumn, table *binTable, row int) (time.Time, error) {
+	mjdEpoch := time.Date(1858, 11, 17, 0, 0, 0, 0, time.UTC)
+	if column.dataType == 'A' {
+		return parseSysTime(strings.TrimSuffix(table.stringValue(row, column), "Z"))
+	}
+	days := table.floatValue(row, column)
+	if strings.EqualFold(column.name, "JD") {
+		days -= 2400000.5
+	}
+	return mjdEpoch.Add(time.Duration(days * 86400 * 1_000_000_000)), nil
+}
+
+func readCubeTiming(path string, numPlanes int, expTimeSeconds float64) (cubeTiming, error) {
+	// Finds the first BINTABLE with a start time column and at least a row per plane
+	var timing cubeTiming
+	f, err := os.Open(path)
+	if err != nil {
+		return timing, err
+	}
+	defer f.Close()
+
+	header, err := readFitsHeader(f)
+	if err != nil {
+		return timing, err
+	}
+	_, err = f.Seek(header.paddedDataBytes(), io.SeekCurrent)
+	if err != nil {
+		return timing, err
+	}
+	for {
+		header, err = readFitsHeader(f)
+		if err == io.EOF {
+			return timing, fmt.Errorf("no table of frame times was found")
+		}
+		if err != nil {
+			return timing, err
+		}
+		if header.stringValue("XTENSION") != "BINTABLE" {
+			_, err = f.Seek(header.paddedDataBytes(), io.SeekCurrent)
+			if err != nil {
+				return timing, err
+			}
+			continue
+		}
+		table, err := readBinTable(f, header)
+		if err != nil {
+			return timing, err
+		}
+		var startColumn binTableColumn
+		found := false
+		for _, name := range cubeStartTimeColumns {
+			startColumn, found = table.column(name)
+			if found {
+				break
+			}
+		}
+		if !found || table.numRows < numPlanes {
+			continue
+		}
+		endColumn, haveEnd := table.column("DATE-END")
+		for row := range numPlanes {
+			startTime, err := parseTableTime(startColumn, table, row)
+			if err != nil {
+				return cubeTiming{}, err
+			}
+			endTime := startTime.Add(time.Duration(expTimeSeconds * 1_000_000_000))
+			if haveEnd {
+				endTime, err = parseTableTime(endColumn, table, row)
+				if err != nil {
+					return cubeTiming{}, err
+				}
+			}
+			timing.startTimes = append(timing.startTimes, startTime)
+			timing.endTimes = append(timing.endTimes, endTime)
+		}
+		return timing, nil
+	}
+}
+
+func readCubePlane(path string, plane int) (*fitsHeader, *frameData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	header, err := readFitsHeader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	format := frameFormatFromHeader(header)
+	bytesPerPixel := max(format.bitpix, -format.bitpix) / 8
+	planeBytes := int64(format.width * format.height * bytesPerPixel)
+	_, err = f.Seek(header.headerBytes+int64(plane)*planeBytes, io.SeekStart)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := make([]byte, planeBytes)
+	_, err = io.ReadFull(f, raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s plane %d: %w", path, plane+1, err)
+	}
+	frame := decodeFrameData(raw, format)
+	if frame == nil {
+		return nil, nil, fmt.Errorf("%s plane %d could not be decoded", path, plane+1)
+	}
+	return header, frame, nil
+}
+
+func cubePlaneTimes(path string, plane int) (start, end time.Time, ok bool) {
+	timing, ok := myWin.cubeTimings[path]
+	if !ok || plane >= len(timing.startTimes) {
+		return time.Time{}, time.Time{}, false
+	}
+	return timing.startTimes[plane], timing.endTimes[plane], true
+}
+
+func formatCubePlaneMetaData(header *fitsHeader, path string, plane int) ([]string, string) {
+	// The cube's primary header, with the plane's time from the table as the timestamp
+	metaDataText, _ := formatHeaderMetaData(header)
+	metaDataText = append([]string{fmt.Sprintf("%8s: %8d (plane of %s)\n", "PLANE", plane+1, path)}, metaDataText...)
+
+	timestamp := "<no timestamp found>"
+	startTime, _, ok := cubePlaneTimes(path, plane)
+	if ok {
+		timestamp = startTime.Format("2006-01-02 15:04:05.000000")
+	}
+	return metaDataText, timestamp
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"FITSreader/fitsio"
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Dropped frames normally exist only in memory (as droppedFrameString entries in myWin.fitsFilePaths).
+// When the user asks for it, a placeholder FITS file is written for each of them so that other tools
+// (PyMovie, Tangra, ...) reading the folder see the true cadence. A placeholder has a blank image
+// (every pixel 0 ADU, or NaN for float pixels), our GPS DATE-OBS and a DROPPED = T card. Its
+// OBS-DATE/DATE-END cards hold the system time the frame would have had, so that re-opening the
+// folder sees no gap.
+
+const droppedFrameCardName = "DROPPED"
+
+func placeholderFilePath(previousFramePath string, n int) string {
+	// Named after the frame that precedes the gap so that an alphabetical listing puts the
+	// placeholders in the right place: xxx.fits < xxx_dropped001.fits < (next frame).fits
+	stem := strings.TrimSuffix(previousFramePath, ".fits")
+	return fmt.Sprintf("%s_dropped%03d.fits", stem, n)
+}
+
+func integerLimits(bitpix int) (lo, hi int64) {
+	switch bitpix {
+	case 16:
+		return math.MinInt16, math.MaxInt16
+	case 32:
+		return math.MinInt32, math.MaxInt32
+	case 64:
+		return math.MinInt64, math.MaxInt64
+	default:
+		return 0, math.MaxUint8 // 8 bit pixels are unsigned
+	}
+}
+
+func pixelScaling(framePath string) (bzero, bscale float64) {
+	// The BZERO and BSCALE of a real frame, so that a placeholder next to it stores its pixels the same way
+	f, err := os.Open(framePath)
+	if err != nil {
+		return 0, 1
+	}
+	defer f.Close()
+	header, err := readFitsHeader(bufio.NewReader(f))
+	if err != nil {
+		return 0, 1
+	}
+	return header.floatValue("BZERO", 0), header.floatValue("BSCALE", 1)
+}
+
+func filledSlice[T any](value T, n int) []T {
+	values := make([]T, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func zeroPixelData(bitpix int, numPixels int, bzero, bscale float64) (data interface{}, stored int64) {
+	// Every pixel is 0 ADU: for integer pixels, the stored value that BZERO and BSCALE turn into 0
+	// (-32768 for the usual unsigned 16 bit frame with BZERO = 32768). Float pixels are NaN.
+	lo, hi := integerLimits(bitpix)
+	stored = max(lo, min(hi, int64(math.Round(-bzero/bscale))))
+	switch bitpix {
+	case 16:
+		return filledSlice(int16(stored), numPixels), stored
+	case 32:
+		return filledSlice(int32(stored), numPixels), stored
+	case 64:
+		return filledSlice(stored, numPixels), stored
+	case -32:
+		return filledSlice(float32(math.NaN()), numPixels), 0
+	case -64:
+		return filledSlice(math.NaN(), numPixels), 0
+	default:
+		return filledSlice(byte(stored), numPixels), stored
+	}
+}
+
+func writePlaceholderFitsFile(path string, gpsTimestamp string, sysStartTime time.Time, bzero, bscale float64) error {
+	const sysTimeFormat = "2006-01-02T15:04:05.0000000" // As written by SharpCap (no trailing Z)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create placeholder file: %w", err)
+	}
+	defer f.Close()
+
+	outFile, err := fitsio.Create(f)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	width := int(myWin.numXpixels)
+	height := int(myWin.numYpixels)
+	img := fitsio.NewImage(myWin.bitpix, []int{width, height})
+	defer img.Close()
+
+	sysEndTime := sysStartTime.Add(time.Duration(myWin.expTimeSeconds * 1_000_000_000))
+	err = img.Header().Append(
+		fitsio.Card{Name: "DATE-OBS", Value: gpsTimestamp, Comment: processedByIotaUtilities},
+		fitsio.Card{Name: "DATE-ERR", Value: fmt.Sprintf("%0.6f", myWin.dateErrSeconds), Comment: "1 sigma time error (seconds)"},
+		fitsio.Card{Name: "FRM-TIME", Value: fmt.Sprintf("%0.6f", myWin.frameTimeSeconds), Comment: "frame time (seconds)"},
+		fitsio.Card{Name: "DEADTIME", Value: fmt.Sprintf("%0.7f", myWin.deadTimeSeconds), Comment: "dead time (seconds)"},
+		fitsio.Card{Name: "GUOFFSET", Value: myWin.gpsUtcOffsetString, Comment: "GPS UTC offset"},
+		fitsio.Card{Name: "OBS-DATE", Value: sysStartTime.Format(sysTimeFormat), Comment: "computed system start time"},
+		fitsio.Card{Name: "DATE-END", Value: sysEndTime.Format(sysTimeFormat), Comment: "computed system end time"},
+		fitsio.Card{Name: "EXPTIME", Value: myWin.expTimeSeconds, Comment: "exposure time (seconds)"},
+		fitsio.Card{Name: droppedFrameCardName, Value: true, Comment: "placeholder for a dropped frame"},
+	)
+	if err != nil {
+		return err
+	}
+	data, stored := zeroPixelData(myWin.bitpix, width*height, bzero, bscale)
+	if myWin.bitpix > 0 {
+		// BLANK is only there to say the frame has no data - it is not the stored value, so that a
+		// reader that honours it sees the same 0 ADU image as one that does not
+		lo, hi := integerLimits(myWin.bitpix)
+		blank := hi
+		if stored == hi {
+			blank = lo
+		}
+		err = img.Header().Append(
+			fitsio.Card{Name: "BZERO", Value: bzero, Comment: "as in the recorded frames"},
+			fitsio.Card{Name: "BSCALE", Value: bscale, Comment: "as in the recorded frames"},
+			fitsio.Card{Name: "BLANK", Value: blank, Comment: "no pixel has this value - the frame was dropped"},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = img.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return outFile.Write(img)
+}
+
+func writeDroppedFramePlaceholders() int {
+	// Called after timestamps have been computed (myWin.timestamps has an entry for every frame,
+	// dropped or not). Returns the number of placeholder files written.
+	numWritten := 0
+	realFrameIndex := -1 // Index into myWin.sysStartTimes of the most recent real frame
+	previousFramePath := ""
+	numInGap := 0
+	for k, frameFile := range myWin.fitsFilePaths {
+		if frameFile != droppedFrameString {
+			realFrameIndex += 1
+			previousFramePath = frameFile
+			numInGap = 0
+			continue
+		}
+		if realFrameIndex < 0 || k >= len(myWin.timestamps) {
+			continue // Cannot happen: a recording never starts with a gap
+		}
+		numInGap += 1
+		sysStartTime := myWin.sysStartTimes[realFrameIndex].Add(
+			time.Duration(float64(numInGap) * myWin.frameTimeSeconds * 1_000_000_000))
+		path := placeholderFilePath(previousFramePath, numInGap)
+		bzero, bscale := pixelScaling(previousFramePath)
+		err := writePlaceholderFitsFile(path, myWin.timestamps[k], sysStartTime, bzero, bscale)
+		if err != nil {
+			log.Printf("could not write placeholder %s: %s\n", path, err)
+			continue
+		}
+		log.Printf("wrote placeholder for dropped frame %d: %s\n", k, path)
+		myWin.fitsFilePaths[k] = path
+		numWritten += 1
+	}
+	return numWritten
+}
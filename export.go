@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Export of frames as ordinary images with the current black/white levels, stretch and inversion
+// applied: the frame on screen, or every frame of the loop range. PNG and JPEG are 8 bit. TIFF is
+// 16 bit, with the stretch computed at 16 bit precision (a difference image is still exported at
+// 8 bit, as it has no levels of its own). A caption with the frame number and timestamp can be
+// burned into the bottom left corner.
+
+const exportPNG = "PNG"
+const exportTIFF = "TIFF (16 bit)"
+const exportJPEG = "JPEG"
+
+var exportFormats = []string{exportPNG, exportTIFF, exportJPEG}
+
+const exportAreaFrame = "whole frame"
+const exportAreaROI = "ROI"
+
+const captionLinesPerImage = 20 // The caption is scaled up to about 1/20 of the image height
+
+func loadExportSettings() {
+	prefs := myWin.App.Preferences()
+	myWin.exportFormat = prefs.StringWithFallback("ExportFormat", exportPNG)
+	myWin.exportArea = prefs.StringWithFallback("ExportArea", exportAreaFrame)
+	myWin.exportCaption = prefs.BoolWithFallback("ExportCaption", true)
+}
+
+func saveExportSettings() {
+	prefs := myWin.App.Preferences()
+	prefs.SetString("ExportFormat", myWin.exportFormat)
+	prefs.SetString("ExportArea", myWin.exportArea)
+	prefs.SetBool("ExportCaption", myWin.exportCaption)
+}
+
+func exportExtension() string {
+	switch myWin.exportFormat {
+	case exportTIFF:
+		return ".tif"
+	case exportJPEG:
+		return ".jpg"
+	}
+	return ".png"
+}
+
+func exportRect(frame *frameData) image.Rectangle {
+	frameRect := image.Rect(0, 0, frame.width, frame.height)
+	if myWin.exportArea == exportAreaROI {
+		if rect := image.Rect(myWin.x0, myWin.y0, myWin.x1, myWin.y1).Intersect(frameRect); !rect.Empty() {
+			return rect
+		}
+	}
+	return frameRect
+}
+
+func renderFrame(frame *frameData, sixteenBit bool) draw.Image {
+	// The exported area of frame, stretched as it is on screen, with its origin at 0,0
+	rect := exportRect(frame)
+	var full image.Image
+	if sixteenBit && !frame.signed {
+		full = render16(frame)
+	} else {
+		buffer := make([]byte, 4*frame.width*frame.height)
+		applyContrastControls(frame, buffer)
+		full = &image.NRGBA{Pix: buffer, Stride: 4 * frame.width, Rect: image.Rect(0, 0, frame.width, frame.height)}
+	}
+	var out draw.Image
+	switch full.(type) {
+	case *image.Gray16:
+		out = image.NewGray16(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	case *image.NRGBA64:
+		out = image.NewNRGBA64(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	default:
+		out = image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	}
+	draw.Draw(out, out.Bounds(), full, rect.Min, draw.Src)
+	return out
+}
+
+func render16(frame *frameData) image.Image {
+	// applyContrastControls() at 16 bits. Invalid pixels (NaN in any plane) are magenta in color frames and 0 in mono frames.
+	statsPixels := statsRegionPixels(frame.pix)
+	bot, top, invert := contrastLevels(statsPixels)
+	f := stretchFunction(statsPixels, bot, top)
+	level := func(value float64) uint16 {
+		t := max(0, min(1, (value-bot)/(top-bot)))
+		if f != nil {
+			t = max(0, min(1, f(t)))
+		}
+		out := uint16(math.Round(65535 * t))
+		if invert {
+			out = ^out
+		}
+		return out
+	}
+
+	rect := image.Rect(0, 0, frame.width, frame.height)
+	if !frame.isColor() {
+		img := image.NewGray16(rect)
+		for i, value := range frame.pix {
+			if !math.IsNaN(value) {
+				img.SetGray16(i%frame.width, i/frame.width, color.Gray16{Y: level(value)})
+			}
+		}
+		return img
+	}
+	img := image.NewNRGBA64(rect)
+	for i := range frame.pix {
+		x, y := i%frame.width, i/frame.width
+		if frame.isInvalid(i) {
+			img.Set(x, y, invalidPixelColor)
+			continue
+		}
+		img.SetNRGBA64(x, y, color.NRGBA64{R: level(frame.red[i]), G: level(frame.green[i]),
+			B: level(frame.blue[i]), A: 0xffff})
+	}
+	return img
+}
+
+func drawCaption(img draw.Image, text string) {
+	// White text on a black band in the bottom left corner. basicfont is drawn at its own size and then
+	// scaled up by whole pixels so that it can be read on large frames.
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil() + 4
+	height := face.Height + 4
+	label := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(label, label.Bounds(), image.Black, image.Point{}, draw.Src)
+	drawer := font.Drawer{Dst: label, Src: image.White, Face: face, Dot: fixed.P(2, 2+face.Ascent)}
+	drawer.DrawString(text)
+
+	bounds := img.Bounds()
+	k := max(1, bounds.Dy()/(captionLinesPerImage*height))
+	top := bounds.Max.Y - height*k
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			block := image.Rect(bounds.Min.X+x*k, top+y*k, bounds.Min.X+(x+1)*k, top+(y+1)*k)
+			draw.Draw(img, block, &image.Uniform{C: label.At(x, y)}, image.Point{}, draw.Src)
+		}
+	}
+}
+
+func writeImageFile(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	switch myWin.exportFormat {
+	case exportTIFF:
+		err = tiff.Encode(f, img, &tiff.Options{Compression: tiff.Deflate})
+	case exportJPEG:
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: 95})
+	default:
+		err = png.Encode(f, img)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func exportFrame(path string, frame *frameData, index int, timestamp string) error {
+	img := renderFrame(frame, myWin.exportFormat == exportTIFF)
+	if myWin.exportCaption {
+		drawCaption(img, fmt.Sprintf("frame %d  %s", index, timestamp))
+	}
+	return writeImageFile(path, img)
+}
+
+func exportCurrentFrame(win fyne.Window) {
+	frame := myWin.shownFrame
+	if frame == nil {
+		dialog.ShowInformation("Export", "There is no frame to export.", win)
+		return
+	}
+	index := myWin.fileIndex
+	timestamp := myWin.timestampLabel.Text
+	fileSave := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+		if err != nil || writer == nil {
+			return
+		}
+		path := writer.URI().Path()
+		_ = writer.Close()
+		err = exportFrame(path, frame, index, timestamp)
+		if err != nil {
+			dialog.ShowInformation("Export", err.Error(), win)
+			return
+		}
+		log.Printf("frame %d exported to %s\n", index, path)
+	}, win)
+	fileSave.SetFileName(fmt.Sprintf("frame_%05d%s", index, exportExtension()))
+	showFileSave(fileSave)
+}
+
+func exportLoopRange(win fyne.Window) {
+	if myWin.loopStartIndex < 0 || myWin.loopEndIndex < 0 {
+		dialog.ShowInformation("Oops", "You need to Set loop start and Set loop end", win)
+		return
+	}
+	if len(myWin.fitsImages) == 0 {
+		return
+	}
+	first := min(myWin.loopStartIndex, myWin.loopEndIndex)
+	last := min(max(myWin.loopStartIndex, myWin.loopEndIndex), len(myWin.fitsFilePaths)-1)
+
+	folderOpen := dialog.NewFolderOpen(func(uri fyne.ListableURI, err error) {
+		if err != nil || uri == nil {
+			return
+		}
+		folder := uri.Path()
+		progress := widget.NewProgressBar()
+		busy := dialog.NewCustomWithoutButtons(fmt.Sprintf("Exporting frames %d to %d", first, last), progress, win)
+		busy.Show()
+		go func() {
+			numWritten := 0
+			for k := first; k <= last; k++ {
+				progress.SetValue(float64(k-first) / float64(last-first+1))
+				path := myWin.fitsFilePaths[k]
+				if path == droppedFrameString {
+					continue
+				}
+				frame, _, timestamp, err := loadFrame(path)
+				if err == nil {
+					err = exportFrame(filepath.Join(folder, fmt.Sprintf("frame_%05d%s", k, exportExtension())),
+						frame, k, timestamp)
+				}
+				if err != nil {
+					busy.Hide()
+					dialog.ShowInformation("Export", err.Error(), win)
+					return
+				}
+				numWritten += 1
+			}
+			busy.Hide()
+			log.Printf("%d frames (%d to %d) exported to %s\n", numWritten, first, last, folder)
+			dialog.ShowInformation("Export", fmt.Sprintf("%d frames were written to\n%s", numWritten, folder), win)
+		}()
+	}, win)
+	folderOpen.Resize(fyne.Size{Width: 800, Height: 600})
+	folderOpen.Show()
+}
+
+func showExportWindow() {
+	trace("")
+	exportWin := myWin.App.NewWindow("Export frames")
+	exportWin.Resize(fyne.Size{Height: 450, Width: 500})
+
+	formatSelector := widget.NewSelect(exportFormats, func(opt string) {
+		myWin.exportFormat = opt
+		saveExportSettings()
+	})
+	formatSelector.Selected = myWin.exportFormat
+	areaSelector := widget.NewSelect([]string{exportAreaFrame, exportAreaROI}, func(opt string) {
+		myWin.exportArea = opt
+		saveExportSettings()
+	})
+	areaSelector.Selected = myWin.exportArea
+	captionCheck := widget.NewCheck("Caption with frame number and timestamp", func(checked bool) {
+		myWin.exportCaption = checked
+		saveExportSettings()
+	})
+	captionCheck.Checked = myWin.exportCaption
+
+	content := container.NewVBox(
+		widget.NewLabel("Frames are exported as they are displayed: black/white levels, stretch and inversion."),
+		widget.NewForm(
+			widget.NewFormItem("Format", formatSelector),
+			widget.NewFormItem("Area", areaSelector),
+		),
+		captionCheck,
+		widget.NewButton("Export displayed frame...", func() { exportCurrentFrame(exportWin) }),
+		widget.NewButton("Export loop range to a folder...", func() { exportLoopRange(exportWin) }),
+		widget.NewSeparator(),
+		videoControls(exportWin),
+	)
+	exportWin.SetContent(content)
+	exportWin.Show()
+	exportWin.CenterOnScreen()
+}
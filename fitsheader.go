@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A minimal FITS header reader. fitsio.Open() decodes every HDU of a file (pixels included), which
+// is far more work than needed when all we want is a few cards and the location of the data. This
+// reads the header blocks only and leaves the reader positioned at the start of the data unit.
+
+const fitsBlockSize = 2880
+const fitsCardSize = 80
+
+type fitsCard struct {
+	name    string
+	value   string // As written - string values have their quotes removed
+	comment string
+}
+
+type fitsHeader struct {
+	cards       []fitsCard
+	headerBytes int64 // Size of the header (a whole number of blocks) - the data unit follows it
+}
+
+func readFitsHeader(r io.Reader) (*fitsHeader, error) {
+	header := new(fitsHeader)
+	block := make([]byte, fitsBlockSize)
+	for {
+		_, err := io.ReadFull(r, block)
+		if err != nil {
+			if len(header.cards) == 0 && errors.Is(err, io.EOF) {
+				return nil, io.EOF // Clean end of file - there are no more HDUs
+			}
+			return nil, fmt.Errorf("reading FITS header: %w", err)
+		}
+		header.headerBytes += fitsBlockSize
+		for i := 0; i < fitsBlockSize; i += fitsCardSize {
+			card := parseFitsCard(string(block[i : i+fitsCardSize]))
+			if card.name == "END" {
+				return header, nil
+			}
+			header.cards = append(header.cards, card)
+		}
+	}
+}
+
+func parseFitsCard(line string) fitsCard {
+	var card fitsCard
+	card.name = strings.TrimSpace(line[0:8])
+	if line[8:10] != "= " {
+		// COMMENT, HISTORY, blank and other commentary cards have no value
+		card.comment = strings.TrimSpace(line[8:])
+		return card
+	}
+	rest := strings.TrimSpace(line[10:])
+	if strings.HasPrefix(rest, "'") {
+		// A string value. A doubled quote ('') stands for a single quote in the text.
+		var text strings.Builder
+		i := 1
+		for i < len(rest) {
+			if rest[i] == '\'' {
+				if i+1 < len(rest) && rest[i+1] == '\'' {
+					text.WriteByte('\'')
+					i += 2
+					continue
+				}
+				break
+			}
+			text.WriteByte(rest[i])
+			i += 1
+		}
+		card.value = strings.TrimRight(text.String(), " ")
+		rest = rest[min(i+1, len(rest)):]
+		if slash := strings.Index(rest, "/"); slash >= 0 {
+			card.comment = strings.TrimSpace(rest[slash+1:])
+		}
+		return card
+	}
+	if slash := strings.Index(rest, "/"); slash >= 0 {
+		card.comment = strings.TrimSpace(rest[slash+1:])
+		rest = rest[:slash]
+	}
+	card.value = strings.TrimSpace(rest)
+	return card
+}
+
+func (h *fitsHeader) get(name string) (fitsCard, bool) {
+	// As everywhere else in this program, the first card with the name is the one that counts
+	for _, card := range h.cards {
+		if card.name == name {
+			return card, true
+		}
+	}
+	return fitsCard{}, false
+}
+
+func (h *fitsHeader) has(name string) bool {
+	_, ok := h.get(name)
+	return ok
+}
+
+func (h *fitsHeader) stringValue(name string) string {
+	card, _ := h.get(name)
+	return card.value
+}
+
+func (h *fitsHeader) intValue(name string, fallback int) int {
+	card, ok := h.get(name)
+	if !ok {
+		return fallback
+	}
+	value, err := strconv.Atoi(card.value)
+	if err != nil {
+		// Some writers use a float format for integer valued cards
+		floatValue, err := strconv.ParseFloat(card.value, 64)
+		if err != nil {
+			return fallback
+		}
+		return int(floatValue)
+	}
+	return value
+}
+
+func (h *fitsHeader) floatValue(name string, fallback float64) float64 {
+	card, ok := h.get(name)
+	if !ok {
+		return fallback
+	}
+	// FITS allows a D exponent (Fortran double precision)
+	value, err := strconv.ParseFloat(strings.Replace(card.value, "D", "E", 1), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func (h *fitsHeader) boolValue(name string) bool {
+	return h.stringValue(name) == "T"
+}
+
+func (h *fitsHeader) axes() []int {
+	naxis := h.intValue("NAXIS", 0)
+	axes := make([]int, naxis)
+	for i := range naxis {
+		axes[i] = h.intValue(fmt.Sprintf("NAXIS%d", i+1), 0)
+	}
+	return axes
+}
+
+func (h *fitsHeader) dataBytes() int64 {
+	// Size of the data unit without its padding (FITS standard section 4.4.1.1)
+	axes := h.axes()
+	if len(axes) == 0 {
+		return 0
+	}
+	numElements := int64(1)
+	for _, axis := range axes {
+		numElements *= int64(axis)
+	}
+	bytesPerElement := int64(h.intValue("BITPIX", 8))
+	if bytesPerElement < 0 {
+		bytesPerElement = -bytesPerElement
+	}
+	bytesPerElement /= 8
+	pcount := int64(h.intValue("PCOUNT", 0))
+	gcount := int64(h.intValue("GCOUNT", 1))
+	return bytesPerElement * gcount * (pcount + numElements)
+}
+
+func (h *fitsHeader) paddedDataBytes() int64 {
+	n := h.dataBytes()
+	return (n + fitsBlockSize - 1) / fitsBlockSize * fitsBlockSize
+}
@@ -235,16 +235,11 @@ func processFolderSelectionClosed() {
 func readEdgeTimeFile(path string) {
 	trace(path)
 	var onTimes []string
-	var filePath string
 
 	myWin.leftGoalpostTimestamp = ""
 	myWin.rightGoalpostTimestamp = ""
 
-	if strings.HasSuffix(path, "\\") {
-		filePath = path + edgeTimesFileName
-	} else {
-		filePath = path + "\\" + edgeTimesFileName
-	}
+	filePath := edgeTimeFilePath(path)
 
 	if _, err := os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
 		msg := fmt.Sprintf("Could not find edge time file @ %s\n", filePath)
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"strconv"
+	"sync"
+)
+
+// Decoded frames are kept in a least-recently-used cache whose size is limited by the FrameCacheMB
+// preference. While playing, a background goroutine decodes the frames ahead of the playhead (in the
+// play direction) so that the play loop usually finds the next frame already decoded.
+
+const prefetchDepth = 32 // Most frames decoded ahead of the playhead
+
+type cachedFrame struct {
+	path      string
+	frame     *frameData
+	metaData  []string
+	timestamp string
+	numBytes  int64
+}
+
+type frameCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List // Most recently used at the front
+	numBytes   int64
+	limitBytes int64
+	loading    map[string]chan struct{} // Closed when the frame has been decoded
+	generation int                      // Incremented by clear() so that frames read before it are not kept
+	hits       int
+	misses     int
+	prefetch   chan []string // Paths to decode ahead, nearest the playhead first
+}
+
+func newFrameCache(limitMB int) *frameCache {
+	c := &frameCache{
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		limitBytes: int64(limitMB) << 20,
+		loading:    map[string]chan struct{}{},
+		prefetch:   make(chan []string, 1),
+	}
+	go c.prefetcher()
+	return c
+}
+
+func frameBytes(frame *frameData) int64 {
+	numPixels := len(frame.pix) + len(frame.red) + len(frame.green) + len(frame.blue)
+	if frame.raw != nil {
+		return int64(numPixels)*8 + frameBytes(frame.raw)
+	}
+	return int64(numPixels) * 8
+}
+
+func (c *frameCache) get(path string) (*cachedFrame, bool, error) {
+	// Returns the decoded frame and whether it was found in the cache (or was being prefetched)
+	c.mu.Lock()
+	for {
+		if element, ok := c.entries[path]; ok {
+			c.lru.MoveToFront(element)
+			c.hits += 1
+			c.mu.Unlock()
+			return element.Value.(*cachedFrame), true, nil
+		}
+		done, ok := c.loading[path]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-done // The prefetcher is decoding it right now
+		c.mu.Lock()
+	}
+	c.misses += 1
+	entry, err := c.load(path)
+	c.mu.Unlock()
+	return entry, false, err
+}
+
+func (c *frameCache) load(path string) (*cachedFrame, error) {
+	// Called with c.mu held. The lock is released while the file is read and decoded.
+	done := make(chan struct{})
+	c.loading[path] = done
+	generation := c.generation
+	c.mu.Unlock()
+
+	frame, metaData, timestamp, err := loadFrame(path)
+
+	c.mu.Lock()
+	delete(c.loading, path)
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	entry := &cachedFrame{path: path, frame: frame, metaData: metaData, timestamp: timestamp,
+		numBytes: frameBytes(frame)}
+	if generation == c.generation {
+		c.entries[path] = c.lru.PushFront(entry)
+		c.numBytes += entry.numBytes
+		c.evict()
+	}
+	return entry, nil
+}
+
+func (c *frameCache) evict() {
+	// Called with c.mu held. The most recently used frame is always kept, whatever its size.
+	for c.numBytes > c.limitBytes && c.lru.Len() > 1 {
+		oldest := c.lru.Back()
+		entry := c.lru.Remove(oldest).(*cachedFrame)
+		delete(c.entries, entry.path)
+		c.numBytes -= entry.numBytes
+	}
+}
+
+func (c *frameCache) clear() {
+	// For a new folder, a new color channel, or files that have been rewritten
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.numBytes = 0
+	c.generation += 1
+	c.hits = 0
+	c.misses = 0
+}
+
+func (c *frameCache) setLimit(limitMB int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limitBytes = int64(limitMB) << 20
+	c.evict()
+}
+
+func (c *frameCache) stats() (hits, misses int, numBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.numBytes
+}
+
+func (c *frameCache) requestPrefetch(paths []string) {
+	// Replaces any request the prefetcher has not started on - only the latest playhead position matters
+	select {
+	case <-c.prefetch:
+	default:
+	}
+	select {
+	case c.prefetch <- paths:
+	default:
+	}
+}
+
+func (c *frameCache) prefetcher() {
+	for paths := range c.prefetch {
+		var ahead int64 // Bytes of decoded frames ahead of the playhead
+		for _, path := range paths {
+			if len(c.prefetch) > 0 {
+				break // The playhead has moved on
+			}
+			if path == droppedFrameString {
+				continue
+			}
+			c.mu.Lock()
+			if element, ok := c.entries[path]; ok {
+				ahead += element.Value.(*cachedFrame).numBytes
+			} else if _, ok := c.loading[path]; !ok {
+				entry, err := c.load(path)
+				if err == nil {
+					ahead += entry.numBytes
+				}
+			}
+			// Half the cache is left for the frames behind the playhead (they are displayed again when looping)
+			full := ahead > c.limitBytes/2
+			c.mu.Unlock()
+			if full {
+				break
+			}
+		}
+	}
+}
+
+func prefetchAhead(step int, loop bool) {
+	// Queues the frames that follow myWin.fileIndex when playing in the step direction (+1 or -1)
+	var paths []string
+	index := myWin.fileIndex
+	for len(paths) < prefetchDepth {
+		if loop && index == myWin.loopEndIndex {
+			index = myWin.loopStartIndex
+		} else {
+			index += step
+		}
+		if index < 0 || index >= len(myWin.fitsFilePaths) {
+			break
+		}
+		paths = append(paths, myWin.fitsFilePaths[index])
+	}
+	myWin.frameCache.requestPrefetch(paths)
+}
+
+func showCacheStatus(hit bool) {
+	hits, misses, numBytes := myWin.frameCache.stats()
+	source := "disk"
+	if hit {
+		source = "cache"
+	}
+	myWin.cacheLabel.SetText(fmt.Sprintf("frame from %s   cache: %d%% hits  %d MB",
+		source, 100*hits/max(hits+misses, 1), numBytes>>20))
+}
+
+func loadFrameCacheSettings() {
+	myWin.frameCacheMB = myWin.App.Preferences().IntWithFallback("FrameCacheMB", 1024)
+	myWin.frameCache = newFrameCache(myWin.frameCacheMB)
+}
+
+func frameCacheSettingsEntry() {
+	sizeEntry := widget.NewEntry()
+	sizeEntry.SetText(strconv.Itoa(myWin.frameCacheMB))
+	items := []*widget.FormItem{
+		widget.NewFormItem("Frame cache size (MB, >= 16)", sizeEntry),
+	}
+	dialog.ShowForm("Frame cache", "OK", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		limitMB, err := strconv.Atoi(sizeEntry.Text)
+		if err != nil || limitMB < 16 {
+			dialog.ShowInformation("Oops", "The cache size must be a whole number of at least 16 MB.", myWin.parentWindow)
+			return
+		}
+		myWin.frameCacheMB = limitMB
+		myWin.App.Preferences().SetInt("FrameCacheMB", myWin.frameCacheMB)
+		myWin.frameCache.setLimit(myWin.frameCacheMB)
+	}, myWin.parentWindow)
+}
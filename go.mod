@@ -8,6 +8,7 @@ require (
 	//github.com/bob-anderson-ok/fitsio v0.0.0-20230228111507-f7769148dd4e
 	github.com/montanaflynn/stats v0.7.1
 	github.com/qdm12/reprint v0.0.0-20200326205758-722754a53494
+	golang.org/x/image v0.11.0
 	gonum.org/v1/plot v0.14.0
 )
 
@@ -40,7 +41,6 @@ require (
 	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/tevino/abool v1.2.0 // indirect
 	github.com/yuin/goldmark v1.5.5 // indirect
-	golang.org/x/image v0.11.0 // indirect
 	golang.org/x/mobile v0.0.0-20230531173138-3c911d8e3eda // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
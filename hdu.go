@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Multi-extension files. A frame is the first image in its file: the primary HDU, or (when the
+// primary is empty, as in the output of fpack) the first image extension. The HDU browser lists every
+// HDU of the current file with its header and can display any image among them.
+
+type hduInfo struct {
+	index      int
+	header     *fitsHeader
+	dataOffset int64 // From the start of the file
+}
+
+func listHDUs(path string) ([]hduInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hdus []hduInfo
+	offset := int64(0)
+	for {
+		header, err := readFitsHeader(f)
+		if err == io.EOF {
+			return hdus, nil
+		}
+		if err != nil {
+			if len(hdus) > 0 {
+				return hdus, nil // Trailing junk after the last HDU is ignored
+			}
+			return nil, err
+		}
+		hdu := hduInfo{index: len(hdus), header: header, dataOffset: offset + header.headerBytes}
+		hdus = append(hdus, hdu)
+		offset = hdu.dataOffset + header.paddedDataBytes()
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return hdus, nil
+		}
+	}
+}
+
+func (h hduInfo) kind() string {
+	if h.index == 0 {
+		return "PRIMARY"
+	}
+	if isCompressedImage(h.header) {
+		return "COMPRESSED IMAGE (" + h.header.stringValue("ZCMPTYPE") + ")"
+	}
+	return h.header.stringValue("XTENSION")
+}
+
+func (h hduInfo) hasImage() bool {
+	if isCompressedImage(h.header) {
+		return true
+	}
+	if h.index > 0 && h.header.stringValue("XTENSION") != "IMAGE" {
+		return false
+	}
+	axes := h.header.axes()
+	return len(axes) >= 2 && axes[0] > 0 && axes[1] > 0
+}
+
+func (h hduInfo) description() string {
+	text := fmt.Sprintf("HDU %d: %s", h.index, h.kind())
+	if name := h.header.stringValue("EXTNAME"); name != "" {
+		text += "  " + name
+	}
+	header := h.header
+	if isCompressedImage(header) {
+		header = uncompressedHeader(header)
+	}
+	axes := header.axes()
+	if h.hasImage() {
+		text += fmt.Sprintf("  %dx%d  BITPIX %d", axes[0], axes[1], header.intValue("BITPIX", 8))
+	} else if len(axes) >= 2 {
+		text += fmt.Sprintf("  %d rows", axes[1])
+	}
+	return text
+}
+
+func headerMetaDataLines(header *fitsHeader) []string {
+	// The same layout as formatMetaData()
+	var metaDataText []string
+	for _, card := range header.cards {
+		if card.comment == "" {
+			metaDataText = append(metaDataText, fmt.Sprintf("%8s: %8v\n", card.name, card.value))
+		} else {
+			metaDataText = append(metaDataText, fmt.Sprintf("%8s: %8v (%s)\n", card.name, card.value, card.comment))
+		}
+	}
+	return metaDataText
+}
+
+func formatHeaderMetaData(header *fitsHeader) ([]string, string) {
+	// formatMetaData() for a header read with readFitsHeader()
+	timestamp := "<no timestamp found>"
+	if card, ok := header.get("DATE-OBS"); ok {
+		timestamp = strings.Replace(card.value, "T", " ", 1)
+	}
+	return headerMetaDataLines(header), timestamp
+}
+
+func readHDUFrame(path string, hdu hduInfo) (*frameData, *fitsHeader, error) {
+	// Returns the image and its header (for a compressed image, the header of the original image)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	_, err = f.Seek(hdu.dataOffset, io.SeekStart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw []byte
+	header := hdu.header
+	if isCompressedImage(hdu.header) {
+		table, err := readBinTable(f, hdu.header)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw, header, err = decompressImage(table)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		raw = make([]byte, hdu.header.dataBytes())
+		_, err = io.ReadFull(f, raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s HDU %d: %w", path, hdu.index, err)
+		}
+	}
+	frame := decodeFrameData(raw, frameFormatFromHeader(header))
+	if frame == nil {
+		return nil, nil, fmt.Errorf("%s HDU %d could not be decoded", path, hdu.index)
+	}
+	return frame, header, nil
+}
+
+func readFirstImage(path string) (*frameData, *fitsHeader, error) {
+	// For files whose primary HDU has no image. The cards of the primary header follow those of the
+	// image header so that cards kept only in the primary (DATE-OBS, say) are still found.
+	hdus, err := listHDUs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, hdu := range hdus {
+		if !hdu.hasImage() {
+			continue
+		}
+		frame, header, err := readHDUFrame(path, hdu)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdu.index > 0 {
+			merged := &fitsHeader{headerBytes: header.headerBytes}
+			merged.cards = append(append(merged.cards, header.cards...), hdus[0].header.cards...)
+			header = merged
+		}
+		return frame, header, nil
+	}
+	return nil, nil, fmt.Errorf("no images are present in %s", path)
+}
+
+func showHDUBrowser() {
+	trace("")
+	if len(myWin.fitsFilePaths) == 0 {
+		return
+	}
+	path, _, _ := parseCubePlaneRef(myWin.fitsFilePaths[myWin.fileIndex])
+	if path == droppedFrameString {
+		dialog.ShowInformation("HDU browser", "There is no file for a dropped frame.", myWin.parentWindow)
+		return
+	}
+	hdus, err := listHDUs(path)
+	if err != nil {
+		dialog.ShowInformation("HDU browser", err.Error(), myWin.parentWindow)
+		return
+	}
+
+	browserWin := myWin.App.NewWindow("HDUs of: " + filepath.Base(path))
+	browserWin.Resize(fyne.Size{Height: 600, Width: 900})
+
+	headerText := widget.NewRichTextWithText("")
+	displayButton := widget.NewButton("Display this image", nil)
+	displayButton.Disable()
+	selected := -1
+
+	hduList := widget.NewList(
+		func() int { return len(hdus) },
+		func() fyne.CanvasObject {
+			return widget.NewLabel("HDU 0: COMPRESSED IMAGE (RICE_1)  0000x0000 BITPIX -32")
+		},
+		func(i widget.ListItemID, item fyne.CanvasObject) { item.(*widget.Label).SetText(hdus[i].description()) },
+	)
+	hduList.OnSelected = func(i widget.ListItemID) {
+		selected = i
+		headerText.Segments = []widget.RichTextSegment{&widget.TextSegment{
+			Style: widget.RichTextStyleCodeBlock, Text: strings.Join(headerMetaDataLines(hdus[i].header), "")}}
+		headerText.Refresh()
+		if hdus[i].hasImage() {
+			displayButton.Enable()
+		} else {
+			displayButton.Disable()
+		}
+	}
+	displayButton.OnTapped = func() {
+		if selected < 0 {
+			return
+		}
+		frame, _, err := readHDUFrame(path, hdus[selected])
+		if err != nil {
+			dialog.ShowInformation("HDU browser", err.Error(), browserWin)
+			return
+		}
+		frame = calibrateFrame(frame)
+		myWin.frame = frame
+		myWin.fileLabel.SetText(fmt.Sprintf("%s  (HDU %d)", path, selected))
+		showFrame(frame)
+	}
+
+	left := container.NewBorder(nil, displayButton, nil, nil, hduList)
+	split := container.NewHSplit(left, container.NewScroll(headerText))
+	split.Offset = 0.4
+	browserWin.SetContent(split)
+	browserWin.Show()
+	browserWin.CenterOnScreen()
+	hduList.Select(0)
+}
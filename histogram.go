@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"image"
+	"image/color"
+	"math"
+)
+
+// The histogram panel shows the pixel values of the displayed frame (or of the ROI) with the black
+// and white slider levels drawn as markers that can be dragged. Bins below the lower level are drawn
+// in blue and bins above the upper level in red, so clipping is visible at a glance. The panel is
+// docked under the image or floated in its own window, and follows every frame shown during playback.
+
+const histRegionFrame = "whole frame"
+const histRegionROI = "ROI"
+
+const numHistBins = 256
+const histImageHeight = 100 // The bars are drawn into a numHistBins x histImageHeight image that is stretched to fit
+const histRangePad = 0.1    // Fraction of the data range added at each end so that the markers can be dragged past it
+
+var blackMarkerColor = color.NRGBA{R: 60, G: 140, B: 255, A: 255}
+var whiteMarkerColor = color.NRGBA{R: 255, G: 90, B: 60, A: 255}
+
+type histogramView struct {
+	widget.BaseWidget
+	bars        *canvas.Image
+	blackMarker *canvas.Line
+	whiteMarker *canvas.Line
+	lo          float64 // The pixel values at the left and right edges
+	hi          float64
+	dragSlider  *widget.Slider // The slider whose marker is being dragged - nil when not dragging
+}
+
+func newHistogramView() *histogramView {
+	h := &histogramView{}
+	h.bars = canvas.NewImageFromImage(image.NewNRGBA(image.Rect(0, 0, numHistBins, histImageHeight)))
+	h.bars.FillMode = canvas.ImageFillStretch
+	h.blackMarker = canvas.NewLine(blackMarkerColor)
+	h.blackMarker.StrokeWidth = 2
+	h.whiteMarker = canvas.NewLine(whiteMarkerColor)
+	h.whiteMarker.StrokeWidth = 2
+	h.ExtendBaseWidget(h)
+	return h
+}
+
+func (h *histogramView) CreateRenderer() fyne.WidgetRenderer {
+	return &histogramViewRenderer{view: h}
+}
+
+func loadHistogramSettings() {
+	prefs := myWin.App.Preferences()
+	myWin.histogramLogScale = prefs.BoolWithFallback("HistogramLogScale", true)
+	myWin.histogramRegion = prefs.StringWithFallback("HistogramRegion", histRegionFrame)
+}
+
+func histogramPixels(frame *frameData) []float64 {
+	rect := image.Rect(0, 0, frame.width, frame.height)
+	if myWin.histogramRegion == histRegionROI {
+		rect = image.Rect(myWin.x0, myWin.y0, myWin.x1, myWin.y1).Intersect(rect)
+	}
+	var values []float64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if value := frame.at(x, y); !math.IsNaN(value) {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func (h *histogramView) setFrame(frame *frameData) {
+	values := histogramPixels(frame)
+	if h.dragSlider == nil {
+		// The range is held while a marker is dragged, otherwise the marker would slide under the cursor
+		h.lo, h.hi = math.Inf(1), math.Inf(-1)
+		for _, value := range values {
+			h.lo = min(h.lo, value)
+			h.hi = max(h.hi, value)
+		}
+		if len(values) == 0 || h.hi <= h.lo {
+			h.lo, h.hi = myWin.blackSlider.Min, myWin.blackSlider.Max
+		}
+		pad := histRangePad * (h.hi - h.lo)
+		h.lo -= pad
+		h.hi += pad
+	}
+
+	lowLevel := min(myWin.blackSlider.Value, myWin.whiteSlider.Value)
+	highLevel := max(myWin.blackSlider.Value, myWin.whiteSlider.Value)
+	var counts [numHistBins]int
+	numLow, numHigh := 0, 0
+	for _, value := range values {
+		bin := int((value - h.lo) / (h.hi - h.lo) * numHistBins)
+		counts[max(0, min(bin, numHistBins-1))] += 1
+		if value <= lowLevel {
+			numLow += 1
+		} else if value >= highLevel {
+			numHigh += 1
+		}
+	}
+	maxCount := 0
+	for _, count := range counts {
+		maxCount = max(maxCount, count)
+	}
+
+	bars := image.NewNRGBA(image.Rect(0, 0, numHistBins, histImageHeight))
+	for bin, count := range counts {
+		if count == 0 {
+			continue
+		}
+		height := float64(count) / float64(maxCount)
+		if myWin.histogramLogScale {
+			height = math.Log1p(float64(count)) / math.Log1p(float64(maxCount))
+		}
+		barColor := color.NRGBA{R: 160, G: 160, B: 160, A: 255}
+		binValue := h.lo + (float64(bin)+0.5)/numHistBins*(h.hi-h.lo)
+		if binValue <= lowLevel {
+			barColor = blackMarkerColor
+		} else if binValue >= highLevel {
+			barColor = whiteMarkerColor
+		}
+		for y := histImageHeight - max(1, int(math.Round(height*histImageHeight))); y < histImageHeight; y++ {
+			bars.SetNRGBA(bin, y, barColor)
+		}
+	}
+	h.bars.Image = bars
+	h.Refresh()
+
+	if myWin.histogramLabel != nil {
+		numValues := max(len(values), 1)
+		myWin.histogramLabel.SetText(fmt.Sprintf("clipped low: %0.2f%%  high: %0.2f%%",
+			100*float64(numLow)/float64(numValues), 100*float64(numHigh)/float64(numValues)))
+	}
+}
+
+func (h *histogramView) xOf(value float64) float32 {
+	// Values off the ends are drawn at the ends
+	t := max(0, min(1, (value-h.lo)/(h.hi-h.lo)))
+	return float32(t) * h.Size().Width
+}
+
+func (h *histogramView) Dragged(event *fyne.DragEvent) {
+	if myWin.blackSlider == nil || h.hi <= h.lo || myWin.shownFrame == nil {
+		return
+	}
+	if h.dragSlider == nil {
+		// The marker nearest to where the drag started is the one that moves
+		startX := event.Position.X - event.Dragged.DX
+		h.dragSlider = myWin.blackSlider
+		if abs32(startX-h.xOf(myWin.whiteSlider.Value)) < abs32(startX-h.xOf(myWin.blackSlider.Value)) {
+			h.dragSlider = myWin.whiteSlider
+		}
+	}
+	value := h.lo + float64(event.Position.X/h.Size().Width)*(h.hi-h.lo)
+	h.dragSlider.SetValue(value) // This redisplays the frame (and so the histogram)
+}
+
+func (h *histogramView) DragEnd() {
+	h.dragSlider = nil
+}
+
+type histogramViewRenderer struct {
+	view *histogramView
+}
+
+func (r *histogramViewRenderer) Layout(size fyne.Size) {
+	r.view.bars.Move(fyne.NewPos(0, 0))
+	r.view.bars.Resize(size)
+	if myWin.blackSlider == nil || r.view.hi <= r.view.lo {
+		r.view.blackMarker.Hide()
+		r.view.whiteMarker.Hide()
+		return
+	}
+	for _, marker := range []struct {
+		line  *canvas.Line
+		value float64
+	}{{r.view.blackMarker, myWin.blackSlider.Value}, {r.view.whiteMarker, myWin.whiteSlider.Value}} {
+		x := r.view.xOf(marker.value)
+		marker.line.Position1 = fyne.NewPos(x, 0)
+		marker.line.Position2 = fyne.NewPos(x, size.Height)
+		marker.line.Show()
+	}
+}
+
+func (r *histogramViewRenderer) MinSize() fyne.Size {
+	return fyne.NewSize(numHistBins, histImageHeight)
+}
+
+func (r *histogramViewRenderer) Refresh() {
+	r.Layout(r.view.Size())
+	r.view.bars.Refresh()
+	r.view.blackMarker.Refresh()
+	r.view.whiteMarker.Refresh()
+}
+
+func (r *histogramViewRenderer) Objects() []fyne.CanvasObject {
+	return []fyne.CanvasObject{r.view.bars, r.view.blackMarker, r.view.whiteMarker}
+}
+
+func (r *histogramViewRenderer) Destroy() {}
+
+func updateHistogram(frame *frameData) {
+	// Called for every frame shown
+	if histogramShown() && frame != nil && myWin.blackSlider != nil {
+		myWin.histogram.setFrame(frame)
+	}
+}
+
+func histogramShown() bool {
+	return myWin.histogram != nil && (len(myWin.histogramDock.Objects) > 0 || myWin.histogramWindow != nil)
+}
+
+func buildHistogramPanel() {
+	myWin.histogram = newHistogramView()
+	myWin.histogramLabel = widget.NewLabel("")
+
+	logCheck := widget.NewCheck("log scale", func(checked bool) {
+		myWin.histogramLogScale = checked
+		myWin.App.Preferences().SetBool("HistogramLogScale", checked)
+		updateHistogram(myWin.shownFrame)
+	})
+	logCheck.SetChecked(myWin.histogramLogScale)
+
+	regionSelector := widget.NewSelect([]string{histRegionFrame, histRegionROI}, func(opt string) {
+		myWin.histogramRegion = opt
+		myWin.App.Preferences().SetString("HistogramRegion", opt)
+		updateHistogram(myWin.shownFrame)
+	})
+	regionSelector.Selected = myWin.histogramRegion
+
+	myWin.histogramDockButton = widget.NewButton("Float", func() {
+		if myWin.histogramWindow == nil {
+			floatHistogram()
+		} else {
+			dockHistogram()
+		}
+	})
+
+	controls := container.NewHBox(logCheck, regionSelector, myWin.histogramLabel)
+	myWin.histogramPanel = container.NewBorder(nil, nil, nil,
+		container.NewVBox(controls, myWin.histogramDockButton), myWin.histogram)
+}
+
+func toggleHistogram() {
+	if myWin.histogram == nil {
+		buildHistogramPanel()
+	}
+	if histogramShown() {
+		if myWin.histogramWindow != nil {
+			myWin.histogramWindow.Close() // Its OnClosed takes care of the rest
+		} else {
+			myWin.histogramDock.Objects = nil
+			myWin.histogramDock.Refresh()
+		}
+		return
+	}
+	dockHistogram()
+}
+
+func dockHistogram() {
+	if myWin.histogramWindow != nil {
+		histWin := myWin.histogramWindow
+		myWin.histogramWindow = nil
+		histWin.SetContent(widget.NewLabel("")) // The panel can only be in one place
+		histWin.Close()
+	}
+	myWin.histogramDockButton.SetText("Float")
+	myWin.histogramDock.Objects = []fyne.CanvasObject{myWin.histogramPanel}
+	myWin.histogramDock.Refresh()
+	updateHistogram(myWin.shownFrame)
+}
+
+func floatHistogram() {
+	myWin.histogramDock.Objects = nil
+	myWin.histogramDock.Refresh()
+
+	histWin := myWin.App.NewWindow("Histogram")
+	histWin.Resize(fyne.Size{Height: 250, Width: 800})
+	histWin.SetOnClosed(func() {
+		if myWin.histogramWindow == histWin {
+			myWin.histogramWindow = nil // Closed by the user - the histogram is hidden
+		}
+	})
+	myWin.histogramWindow = histWin
+	myWin.histogramDockButton.SetText("Dock")
+	histWin.SetContent(myWin.histogramPanel)
+	histWin.Show()
+	updateHistogram(myWin.shownFrame)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/widget"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+)
+
+// imageView shows myWin.fitsImages[0] and lets the user drag out a box on it. What the box is for
+// depends on myWin.imageDragMode - when that is empty, a drag pans the zoomed image instead.
+// In dragModeROI the ROI is drawn over the image with handles: dragging a handle resizes it,
+// dragging inside it moves it and dragging anywhere else draws a new one.
+// The mouse wheel zooms around the cursor, a double click goes back to the whole image, and the
+// pixel under the cursor is reported in myWin.pixelLabel. The paths of tracked apertures are drawn
+// over the image by placeTrackOverlay() in tracking.go.
+
+const dragModeNone = ""
+const dragModeAutoContrastBox = "autoContrastBox"
+const dragModeROI = "roi" // Stays set (unlike the others) until "Draw ROI on image" is unchecked
+
+const roiDragNone = 0
+const roiDragNew = 1
+const roiDragMove = 2
+const roiDragHandle = 3
+
+const roiHandleSize = 9 // Screen pixels
+const minROISize = 4    // Image pixels - a smaller drawn ROI (a click, say) is ignored
+
+// Where the handles are on the ROI: 0 moves its left (top) edge, 1 its right (bottom) edge
+var roiHandleSpots = [8][2]float64{{0, 0}, {0.5, 0}, {1, 0}, {1, 0.5}, {1, 1}, {0.5, 1}, {0, 1}, {0, 0.5}}
+
+const maxZoom = 64.0       // The view is then 1/64 of the image (or ROI) width
+const zoomStep = 1.25      // Per mouse wheel click
+const pixelatedScale = 2.0 // Screen pixels per image pixel from which pixels are drawn as squares
+
+type imageView struct {
+	widget.BaseWidget
+	image     *canvas.Image
+	box       *canvas.Rectangle
+	dragStart fyne.Position
+	dragEnd   fyne.Position
+	dragging  bool
+	base      image.Rectangle // The whole image or the ROI - what is shown at zoom 1
+	zoom      float64
+	viewX     float64 // Top left corner of the zoomed view in image pixels
+	viewY     float64
+	// The ROI overlay of dragModeROI
+	roiBox       *canvas.Rectangle
+	roiHandles   [8]*canvas.Rectangle
+	roiDrag      int             // One of the roiDrag constants
+	roiHandle    int             // Index into roiHandles of the handle being dragged
+	roiStartRect image.Rectangle // The ROI when the drag started
+	roiStartX    float64         // Image coordinates of the drag start
+	roiStartY    float64
+	roiRect      image.Rectangle // The ROI as it is being dragged
+	trackOverlay *fyne.Container // Aperture paths and positions - see placeTrackOverlay()
+}
+
+func newImageView(img *canvas.Image) *imageView {
+	view := &imageView{image: img, zoom: 1}
+	view.box = canvas.NewRectangle(color.Transparent)
+	view.box.StrokeColor = color.NRGBA{G: 255, A: 255}
+	view.box.StrokeWidth = 1
+	view.box.Hide()
+	view.roiBox = canvas.NewRectangle(color.Transparent)
+	view.roiBox.StrokeColor = color.NRGBA{R: 255, G: 255, A: 255}
+	view.roiBox.StrokeWidth = 1
+	view.roiBox.Hide()
+	for i := range view.roiHandles {
+		view.roiHandles[i] = canvas.NewRectangle(color.NRGBA{R: 255, G: 255, A: 255})
+		view.roiHandles[i].Hide()
+	}
+	view.trackOverlay = container.NewWithoutLayout()
+	view.ExtendBaseWidget(view)
+	return view
+}
+
+func (v *imageView) CreateRenderer() fyne.WidgetRenderer {
+	return &imageViewRenderer{view: v}
+}
+
+func (v *imageView) imageLayout() (offset fyne.Position, scale float32) {
+	// Where (and at what scale) the image is drawn with canvas.ImageFillContain
+	bounds := v.image.Image.Bounds()
+	size := v.Size()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return fyne.Position{}, 1
+	}
+	scale = min(size.Width/float32(bounds.Dx()), size.Height/float32(bounds.Dy()))
+	offset.X = (size.Width - scale*float32(bounds.Dx())) / 2
+	offset.Y = (size.Height - scale*float32(bounds.Dy())) / 2
+	return offset, scale
+}
+
+func (v *imageView) toImagePoint(pos fyne.Position) image.Point {
+	// Converts a position in the widget to the image pixel under it (clamped to the image)
+	bounds := v.image.Image.Bounds()
+	offset, scale := v.imageLayout()
+	x := bounds.Min.X + int((pos.X-offset.X)/scale)
+	y := bounds.Min.Y + int((pos.Y-offset.Y)/scale)
+	x = max(bounds.Min.X, min(x, bounds.Max.X-1))
+	y = max(bounds.Min.Y, min(y, bounds.Max.Y-1))
+	return image.Point{X: x, Y: y}
+}
+
+func (v *imageView) toImageCoords(pos fyne.Position) (x, y float64, inside bool) {
+	// The (unclamped) image coordinates of a position in the widget
+	bounds := v.image.Image.Bounds()
+	offset, scale := v.imageLayout()
+	x = float64(bounds.Min.X) + float64((pos.X-offset.X)/scale)
+	y = float64(bounds.Min.Y) + float64((pos.Y-offset.Y)/scale)
+	inside = x >= float64(bounds.Min.X) && x < float64(bounds.Max.X) &&
+		y >= float64(bounds.Min.Y) && y < float64(bounds.Max.Y)
+	return x, y, inside
+}
+
+func (v *imageView) toWidgetPos(x, y float64) fyne.Position {
+	// The inverse of toImageCoords()
+	bounds := v.image.Image.Bounds()
+	offset, scale := v.imageLayout()
+	return fyne.NewPos(offset.X+float32(x-float64(bounds.Min.X))*scale, offset.Y+float32(y-float64(bounds.Min.Y))*scale)
+}
+
+func (v *imageView) applyZoom() {
+	// Called whenever myWin.fitsImages[0].Image has been set to the whole image or to the ROI
+	v.base = v.image.Image.Bounds()
+	v.showView()
+}
+
+func (v *imageView) showView() {
+	if v.zoom <= 1 {
+		v.zoom = 1
+		v.viewX = float64(v.base.Min.X)
+		v.viewY = float64(v.base.Min.Y)
+		v.image.Image = myWin.displayImage.SubImage(v.base)
+	} else {
+		viewWidth := float64(v.base.Dx()) / v.zoom
+		viewHeight := float64(v.base.Dy()) / v.zoom
+		v.viewX = max(float64(v.base.Min.X), min(v.viewX, float64(v.base.Max.X)-viewWidth))
+		v.viewY = max(float64(v.base.Min.Y), min(v.viewY, float64(v.base.Max.Y)-viewHeight))
+		x0 := int(math.Round(v.viewX))
+		y0 := int(math.Round(v.viewY))
+		width := max(1, int(math.Round(viewWidth)))
+		height := max(1, int(math.Round(viewHeight)))
+		v.image.Image = myWin.displayImage.SubImage(image.Rect(x0, y0, x0+width, y0+height).Intersect(v.base))
+	}
+
+	// Nearest neighbour when zoomed in far enough to see the pixels - that is what they are there for
+	_, scale := v.imageLayout()
+	if scale >= pixelatedScale {
+		v.image.ScaleMode = canvas.ImageScalePixels
+	} else {
+		v.image.ScaleMode = canvas.ImageScaleSmooth
+	}
+	v.image.Refresh()
+	v.placeROIOverlay()
+	v.placeTrackOverlay()
+}
+
+func (v *imageView) placeROIOverlay() {
+	// Shown in dragModeROI, while the whole frame is displayed
+	rect := image.Rect(myWin.x0, myWin.y0, myWin.x1, myWin.y1)
+	if v.roiDrag != roiDragNone {
+		rect = v.roiRect
+	}
+	if myWin.imageDragMode != dragModeROI || myWin.roiActive || v.image.Image == nil || rect.Empty() {
+		v.roiBox.Hide()
+		for _, handle := range v.roiHandles {
+			handle.Hide()
+		}
+		return
+	}
+	p0 := v.toWidgetPos(float64(rect.Min.X), float64(rect.Min.Y))
+	p1 := v.toWidgetPos(float64(rect.Max.X), float64(rect.Max.Y))
+	v.roiBox.Move(p0)
+	v.roiBox.Resize(fyne.NewSize(p1.X-p0.X, p1.Y-p0.Y))
+	v.roiBox.Show()
+	v.roiBox.Refresh()
+	for i, handle := range v.roiHandles {
+		x := p0.X + float32(roiHandleSpots[i][0])*(p1.X-p0.X)
+		y := p0.Y + float32(roiHandleSpots[i][1])*(p1.Y-p0.Y)
+		handle.Move(fyne.NewPos(x-roiHandleSize/2, y-roiHandleSize/2))
+		handle.Resize(fyne.NewSize(roiHandleSize, roiHandleSize))
+		handle.Show()
+		handle.Refresh()
+	}
+}
+
+func (v *imageView) beginROIDrag(pos fyne.Position) {
+	v.roiStartRect = image.Rect(myWin.x0, myWin.y0, myWin.x1, myWin.y1)
+	v.roiRect = v.roiStartRect
+	v.roiStartX, v.roiStartY, _ = v.toImageCoords(pos)
+	for i, handle := range v.roiHandles {
+		center := handle.Position().Add(fyne.NewPos(roiHandleSize/2, roiHandleSize/2))
+		if handle.Visible() && abs32(pos.X-center.X) <= roiHandleSize && abs32(pos.Y-center.Y) <= roiHandleSize {
+			v.roiDrag = roiDragHandle
+			v.roiHandle = i
+			return
+		}
+	}
+	if image.Pt(int(math.Floor(v.roiStartX)), int(math.Floor(v.roiStartY))).In(v.roiStartRect) {
+		v.roiDrag = roiDragMove
+	} else {
+		v.roiDrag = roiDragNew
+	}
+}
+
+func (v *imageView) continueROIDrag(pos fyne.Position) {
+	x, y, _ := v.toImageCoords(pos)
+	dx := int(math.Round(x - v.roiStartX))
+	dy := int(math.Round(y - v.roiStartY))
+	// validateROIparameters() wants x1 and y1 inside the image, so that is the limit here too
+	limits := image.Rect(0, 0, myWin.imageWidth-1, myWin.imageHeight-1)
+	rect := v.roiStartRect
+	switch v.roiDrag {
+	case roiDragMove:
+		rect = rect.Add(image.Pt(dx, dy))
+		shift := image.Pt(max(0, limits.Min.X-rect.Min.X)+min(0, limits.Max.X-rect.Max.X),
+			max(0, limits.Min.Y-rect.Min.Y)+min(0, limits.Max.Y-rect.Max.Y))
+		rect = rect.Add(shift)
+	case roiDragHandle:
+		spot := roiHandleSpots[v.roiHandle]
+		if spot[0] == 0 {
+			rect.Min.X += dx
+		} else if spot[0] == 1 {
+			rect.Max.X += dx
+		}
+		if spot[1] == 0 {
+			rect.Min.Y += dy
+		} else if spot[1] == 1 {
+			rect.Max.Y += dy
+		}
+	case roiDragNew:
+		rect = image.Rect(int(math.Floor(v.roiStartX)), int(math.Floor(v.roiStartY)),
+			int(math.Floor(x))+1, int(math.Floor(y))+1)
+	}
+	v.roiRect = rect.Canon().Intersect(limits)
+	v.placeROIOverlay()
+}
+
+func (v *imageView) endROIDrag() {
+	rect := v.roiRect
+	v.roiDrag = roiDragNone
+	if rect.Dx() >= minROISize && rect.Dy() >= minROISize && rect != v.roiStartRect {
+		setROIFromRect(rect) // This redisplays, which puts the overlay on the new ROI
+	} else {
+		v.placeROIOverlay()
+	}
+}
+
+func (v *imageView) resetZoom() {
+	v.zoom = 1
+	if myWin.pixelLabel != nil {
+		myWin.pixelLabel.SetText("")
+	}
+}
+
+func (v *imageView) Scrolled(event *fyne.ScrollEvent) {
+	if v.image.Image == nil || v.base.Empty() || event.Scrolled.DY == 0 {
+		return
+	}
+	x, y, _ := v.toImageCoords(event.Position)
+	oldZoom := v.zoom
+	if event.Scrolled.DY > 0 {
+		v.zoom = min(v.zoom*zoomStep, maxZoom)
+	} else {
+		v.zoom = max(v.zoom/zoomStep, 1)
+	}
+	// Keep the image point under the cursor where it is
+	ratio := oldZoom / v.zoom
+	v.viewX = x - (x-v.viewX)*ratio
+	v.viewY = y - (y-v.viewY)*ratio
+	v.showView()
+	v.showPixelValue(event.Position)
+}
+
+func (v *imageView) DoubleTapped(_ *fyne.PointEvent) {
+	if v.image.Image == nil || v.base.Empty() {
+		return
+	}
+	v.resetZoom()
+	v.showView()
+}
+
+func (v *imageView) MouseIn(event *desktop.MouseEvent) {
+	v.showPixelValue(event.Position)
+}
+
+func (v *imageView) MouseMoved(event *desktop.MouseEvent) {
+	v.showPixelValue(event.Position)
+}
+
+func (v *imageView) MouseOut() {
+	if myWin.pixelLabel != nil {
+		myWin.pixelLabel.SetText("")
+	}
+}
+
+func (v *imageView) showPixelValue(pos fyne.Position) {
+	// x/y and the ADU value (BZERO/BSCALE applied) of the pixel under the cursor. With a dark or flat
+	// loaded, the raw value (for checking saturation) is shown next to the calibrated one.
+	frame := myWin.shownFrame
+	if myWin.pixelLabel == nil || frame == nil || v.image.Image == nil {
+		return
+	}
+	x, y, inside := v.toImageCoords(pos)
+	ix := int(math.Floor(x))
+	iy := int(math.Floor(y))
+	if !inside || ix >= frame.width || iy >= frame.height {
+		myWin.pixelLabel.SetText("")
+		return
+	}
+	text := fmt.Sprintf("x: %d  y: %d  ADU: %s", ix, iy, formatADU(frame.at(ix, iy)))
+	raw := frame.raw
+	if raw != nil && (myWin.displayMode != displaySingle || myWin.stackShown) {
+		// A running mean, difference or stack of calibrated frames has no raw value
+		text = fmt.Sprintf("x: %d  y: %d  calibrated ADU: %s", ix, iy, formatADU(frame.at(ix, iy)))
+		raw = nil
+	}
+	if raw != nil {
+		text = fmt.Sprintf("x: %d  y: %d  raw ADU: %s  calibrated: %s", ix, iy,
+			formatADU(raw.at(ix, iy)), formatADU(frame.at(ix, iy)))
+	}
+	if frame.isColor() {
+		k := iy*frame.width + ix
+		text += fmt.Sprintf("  (R %s  G %s  B %s)",
+			formatADU(frame.red[k]), formatADU(frame.green[k]), formatADU(frame.blue[k]))
+		if raw != nil {
+			text += fmt.Sprintf("  (raw R %s  G %s  B %s)",
+				formatADU(raw.red[k]), formatADU(raw.green[k]), formatADU(raw.blue[k]))
+		}
+	}
+	if v.zoom > 1 {
+		text += fmt.Sprintf("   zoom: %0.1fx", v.zoom)
+	}
+	myWin.pixelLabel.SetText(text)
+}
+
+func formatADU(value float64) string {
+	if math.IsNaN(value) {
+		return "invalid"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (v *imageView) Dragged(event *fyne.DragEvent) {
+	if v.image.Image == nil {
+		return
+	}
+	if myWin.imageDragMode == dragModeROI {
+		if myWin.roiActive {
+			return
+		}
+		if v.roiDrag == roiDragNone {
+			v.beginROIDrag(event.Position.Subtract(event.Dragged))
+		}
+		v.continueROIDrag(event.Position)
+		return
+	}
+	if myWin.imageDragMode == dragModeNone {
+		if v.zoom > 1 {
+			_, scale := v.imageLayout()
+			v.viewX -= float64(event.Dragged.DX / scale)
+			v.viewY -= float64(event.Dragged.DY / scale)
+			v.showView()
+		}
+		return
+	}
+	if !v.dragging {
+		v.dragging = true
+		v.dragStart = event.Position.Subtract(event.Dragged)
+	}
+	v.dragEnd = event.Position
+	v.box.Move(fyne.NewPos(min(v.dragStart.X, v.dragEnd.X), min(v.dragStart.Y, v.dragEnd.Y)))
+	v.box.Resize(fyne.NewSize(abs32(v.dragEnd.X-v.dragStart.X), abs32(v.dragEnd.Y-v.dragStart.Y)))
+	v.box.Show()
+	v.box.Refresh()
+}
+
+func (v *imageView) DragEnd() {
+	if v.roiDrag != roiDragNone {
+		v.endROIDrag()
+		return
+	}
+	if !v.dragging {
+		return
+	}
+	v.dragging = false
+	v.box.Hide()
+	p0 := v.toImagePoint(v.dragStart)
+	p1 := v.toImagePoint(v.dragEnd)
+	rect := image.Rectangle{Min: p0, Max: p1}.Canon()
+	rect.Max = rect.Max.Add(image.Point{X: 1, Y: 1}) // Include the pixel the drag ended on
+
+	mode := myWin.imageDragMode
+	myWin.imageDragMode = idleDragMode()
+	switch mode {
+	case dragModeAutoContrastBox:
+		setAutoContrastBox(rect)
+	}
+}
+
+func abs32(x float32) float32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+type imageViewRenderer struct {
+	view *imageView
+}
+
+func (r *imageViewRenderer) Layout(size fyne.Size) {
+	r.view.image.Move(fyne.NewPos(0, 0))
+	r.view.image.Resize(size)
+	r.view.placeROIOverlay()
+	r.view.placeTrackOverlay()
+}
+
+func (r *imageViewRenderer) MinSize() fyne.Size {
+	return r.view.image.MinSize()
+}
+
+func (r *imageViewRenderer) Refresh() {
+	r.view.image.Refresh()
+}
+
+func (r *imageViewRenderer) Objects() []fyne.CanvasObject {
+	objects := []fyne.CanvasObject{r.view.image, r.view.trackOverlay, r.view.box, r.view.roiBox}
+	for _, handle := range r.view.roiHandles {
+		objects = append(objects, handle)
+	}
+	return objects
+}
+
+func (r *imageViewRenderer) Destroy() {}
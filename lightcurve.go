@@ -1,7 +1,6 @@
 package main
 
 import (
-	"FITSreader/fitsio"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/canvas"
 	"gonum.org/v1/plot"
@@ -9,6 +8,7 @@ import (
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/plotutil"
 	"gonum.org/v1/plot/vg"
+	"math"
 	"time"
 )
 
@@ -21,10 +21,27 @@ func showFlashLightcurve() {
 
 	testImage := canvas.NewImageFromFile("flashLightcurve.png")
 	pngWin.SetContent(testImage)
+	pngWin.SetOnClosed(func() {
+		if myWin.flashPlotWin == pngWin {
+			myWin.flashPlotWin = nil
+		}
+	})
+	myWin.flashPlotWin = pngWin
 	pngWin.CenterOnScreen()
 	pngWin.Show()
 }
 
+func refreshFlashLightcurve() {
+	// Rebuilds the plot after a change of how it is drawn and shows it in the open window (if there is one)
+	if len(myWin.lightcurve) == 0 {
+		return
+	}
+	buildPlot()
+	if myWin.flashPlotWin != nil {
+		myWin.flashPlotWin.SetContent(canvas.NewImageFromFile("flashLightcurve.png"))
+	}
+}
+
 func showSysTimePlots() {
 
 	buildStartTimePlot() // Writes timestampPlot.png in current working directory
@@ -68,10 +85,17 @@ func buildPlot() {
 		return
 	}
 
-	myPts := make(plotter.XYs, n)
-	for i := range myPts {
-		myPts[i].X = float64(i + myWin.lightCurveStartIndex)
-		myPts[i].Y = myWin.lightcurve[i]
+	// Dropped frames are NaN in the lightcurve. They are either left out of the plot or, if the user
+	// asked for it, shown as interpolated values in their own (labelled) series.
+	var myPts, interpolatedPts plotter.XYs
+	interpolated := interpolateMissingSamples(myWin.lightcurve)
+	for i := range myWin.lightcurve {
+		pt := plotter.XY{X: float64(i + myWin.lightCurveStartIndex), Y: interpolated[i]}
+		if !isMissingSample(myWin.lightcurve[i]) {
+			myPts = append(myPts, pt)
+		} else if myWin.interpolateDroppedFrames && !isMissingSample(pt.Y) {
+			interpolatedPts = append(interpolatedPts, pt)
+		}
 	}
 
 	plot.DefaultFont = font.Font{Typeface: "Liberation", Variant: "Sans", Style: 0, Weight: 3, Size: font.Points(20)}
@@ -85,7 +109,12 @@ func buildPlot() {
 
 	plotutil.DefaultGlyphShapes[0] = plotutil.Shape(5) // set point shape to filled circle
 
-	err := plotutil.AddScatters(plt, myPts)
+	var err error
+	if len(interpolatedPts) > 0 {
+		err = plotutil.AddScatters(plt, "measured", myPts, "interpolated (dropped frame)", interpolatedPts)
+	} else {
+		err = plotutil.AddScatters(plt, myPts)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -265,11 +294,51 @@ func buildFrameDeltasPlot() {
 //}
 
 func pixelSum() float64 {
-	var pixelSum float64
+	// Invalid pixels (BLANK or NaN) are left out
+	return myWin.frame.validSum()
+}
+
+// Dropped frames have no measurement. They are carried through the lightcurve as NaN so that
+// every consumer (plots, edge detection, export) can recognize and skip them.
+
+func isMissingSample(value float64) bool {
+	return math.IsNaN(value)
+}
+
+func validSamples(values []float64) []float64 {
+	valid := make([]float64, 0, len(values))
+	for _, value := range values {
+		if !isMissingSample(value) {
+			valid = append(valid, value)
+		}
+	}
+	return valid
+}
 
-	imagePixels := myWin.primaryHDU.(fitsio.Image).Raw()
-	for i := 0; i < len(imagePixels); i += 1 {
-		pixelSum += float64(imagePixels[i])
+func interpolateMissingSamples(values []float64) []float64 {
+	// Returns a copy of values with missing samples replaced by a straight line between the nearest
+	// valid neighbours (or the nearest valid value at either end). Only ever use this for display.
+	filled := make([]float64, len(values))
+	copy(filled, values)
+	lastValid := -1
+	for i := 0; i <= len(values); i++ {
+		if i < len(values) && isMissingSample(values[i]) {
+			continue
+		}
+		if i-lastValid > 1 { // There is a run of missing samples between lastValid and i
+			for k := lastValid + 1; k < i; k++ {
+				switch {
+				case lastValid < 0 && i < len(values):
+					filled[k] = values[i]
+				case lastValid >= 0 && i == len(values):
+					filled[k] = values[lastValid]
+				case lastValid >= 0:
+					fraction := float64(k-lastValid) / float64(i-lastValid)
+					filled[k] = values[lastValid] + fraction*(values[i]-values[lastValid])
+				}
+			}
+		}
+		lastValid = i
 	}
-	return pixelSum
+	return filled
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Lightcurves as a csv file that PyOTE reads directly, in the layout PyMovie writes: # comment lines,
+// then a FrameNum,timeInfo,signal-<name>,... header and one row per frame. timeInfo is the time of day
+// of the frame's DATE-OBS (our GPS timestamp once timestamps have been inserted) as [hh:mm:ss.ssss],
+// with the date in the header. A dropped frame has no measurement, so it has no row - PyOTE sees the
+// jump in FrameNum and timeInfo, as it does in a PyMovie file of a recording with dropped frames
+// (a placeholder file is a dropped frame too).
+// The columns are the flash lightcurve (when there is one) and every measured aperture.
+
+func csvTimeInfo(timestamp string) (date, timeInfo string, ok bool) {
+	// "2024-05-01 03:04:05.123456" (or with a T) gives "2024-05-01" and "[03:04:05.123456]".
+	// false (and empty strings) for a frame without a DATE-OBS.
+	timestamp, ok = fitsTimestamp(strings.TrimSpace(timestamp))
+	if !ok {
+		return "", "", false
+	}
+	date, timeOfDay, found := strings.Cut(timestamp, "T")
+	if !found {
+		return "", "", false
+	}
+	return date, "[" + strings.TrimSuffix(timeOfDay, "Z") + "]", true
+}
+
+func csvColumnName(name string) string {
+	// Commas would break the columns
+	return "signal-" + strings.ReplaceAll(strings.TrimSpace(name), ",", "_")
+}
+
+func writeLightcurveCSV(path string, results *apertureResults) error {
+	var names []string
+	var columns [][]float64
+	if len(myWin.lightcurve) == len(results.paths) {
+		names = append(names, csvColumnName("flash"))
+		columns = append(columns, myWin.lightcurve)
+	}
+	for i, a := range results.apertures {
+		names = append(names, csvColumnName(a.Name))
+		columns = append(columns, results.curves[i])
+	}
+
+	if len(names) == 0 {
+		return errors.New("there is no lightcurve to write: measure the flash or add an aperture first")
+	}
+
+	// A dropped frame (or a placeholder written for one) has no row. Any other missing value (an
+	// aperture off the edge of the frame, say) is interpolated within its own column, as PyOTE
+	// cannot read an empty value, and the frames where that happened are listed in the header.
+	// A frame without a DATE-OBS gets an empty timeInfo, and is listed in the header.
+	var dropped, untimed []string
+	firstDate := ""
+	for k := range results.paths {
+		if results.dropped[k] {
+			dropped = append(dropped, strconv.Itoa(k))
+		} else if date, _, ok := csvTimeInfo(results.timestamp[k]); !ok {
+			untimed = append(untimed, strconv.Itoa(k))
+		} else if firstDate == "" {
+			firstDate = date
+		}
+	}
+	if firstDate == "" {
+		return errors.New("none of the frames has a DATE-OBS card, so there is no timeInfo to write")
+	}
+	var interpolated []string
+	for i, column := range columns {
+		var missing []string
+		for k, value := range column {
+			if isMissingSample(value) && !results.dropped[k] {
+				missing = append(missing, strconv.Itoa(k))
+			}
+		}
+		if len(missing) > 0 {
+			interpolated = append(interpolated, fmt.Sprintf("%s at %s", names[i], strings.Join(missing, " ")))
+			columns[i] = interpolateMissingSamples(column)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(f)
+	fmt.Fprintf(out, "# PyMovie compatible lightcurves written by IOTA FITS Utility %s\n", version)
+	fmt.Fprintf(out, "# source: %s\n", myWin.folderSelected)
+	fmt.Fprintf(out, "# date at frame 0: %s\n", firstDate)
+	fmt.Fprintf(out, "# timeInfo: the first DATE-OBS card of each frame\n")
+	fmt.Fprintf(out, "# %s\n", calibrationDescription())
+	fmt.Fprintf(out, "# sky level: %s  gain: %g electrons per ADU\n", myWin.skyMethod, myWin.photometryGain)
+	for _, a := range results.apertures {
+		fmt.Fprintf(out, "# aperture: %s\n", a.description())
+	}
+	if len(dropped) > 0 {
+		fmt.Fprintf(out, "# dropped frames (no row): %s\n", strings.Join(dropped, " "))
+	}
+	if len(untimed) > 0 {
+		fmt.Fprintf(out, "# no DATE-OBS (empty timeInfo): %s\n", strings.Join(untimed, " "))
+	}
+	for _, text := range interpolated {
+		fmt.Fprintf(out, "# interpolated (no measurement): %s\n", text)
+	}
+	fmt.Fprintf(out, "FrameNum,timeInfo,%s\n", strings.Join(names, ","))
+
+	for k := range results.paths {
+		if results.dropped[k] {
+			continue
+		}
+		_, timeInfo, _ := csvTimeInfo(results.timestamp[k])
+		row := []string{strconv.Itoa(k), timeInfo}
+		for _, column := range columns {
+			value := column[k]
+			if isMissingSample(value) {
+				value = 0 // Only when the whole column is missing - interpolateMissingSamples() has nothing to go on
+			}
+			row = append(row, strconv.FormatFloat(value, 'f', 2, 64))
+		}
+		fmt.Fprintln(out, strings.Join(row, ","))
+	}
+
+	err = out.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func exportLightcurveCSV(win fyne.Window) {
+	if len(myWin.fitsFilePaths) == 0 {
+		dialog.ShowInformation("Lightcurve csv", "Open a folder first.", win)
+		return
+	}
+	if len(myWin.apertures) == 0 && len(myWin.lightcurve) != len(myWin.fitsFilePaths) {
+		dialog.ShowInformation("Lightcurve csv", "There is no lightcurve to write: measure the flash or add an aperture first.", win)
+		return
+	}
+	fileSave := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+		if err != nil || writer == nil {
+			return
+		}
+		path := writer.URI().Path()
+		_ = writer.Close()
+
+		results := myWin.apertureResults
+		if results != nil && slices.Equal(results.paths, myWin.fitsFilePaths) {
+			err = writeLightcurveCSV(path, results)
+			reportLightcurveCSV(path, err, win)
+			return
+		}
+		// The timestamps (and the apertures, if there are any) have to be measured first
+		apertures := make([]aperture, len(myWin.apertures))
+		copy(apertures, myWin.apertures)
+		progress := widget.NewProgressBar()
+		busy := dialog.NewCustomWithoutButtons("Reading frames for the lightcurve csv", progress, win)
+		busy.Show()
+		go func() {
+			results, err := measureApertures(apertures, progress)
+			busy.Hide()
+			if err == nil {
+				myWin.apertureResults = results
+				err = writeLightcurveCSV(path, results)
+			}
+			reportLightcurveCSV(path, err, win)
+		}()
+	}, win)
+	fileSave.SetFileName(filepath.Base(myWin.folderSelected) + ".csv")
+	showFileSave(fileSave)
+}
+
+func reportLightcurveCSV(path string, err error, win fyne.Window) {
+	if err != nil {
+		dialog.ShowInformation("Lightcurve csv", err.Error(), win)
+		return
+	}
+	log.Printf("lightcurves written to %s\n", path)
+	dialog.ShowInformation("Lightcurve csv", "The lightcurves were written to\n"+path, win)
+}
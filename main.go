@@ -3,6 +3,7 @@ package main
 import (
 	"FITSreader/fitsio"
 	_ "embed"
+	"errors"
 	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -26,7 +27,6 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -42,8 +42,6 @@ type Config struct {
 	leftGoalpostStats          *EdgeStats
 	rightGoalpostStats         *EdgeStats
 	adjustSliders              bool
-	blackSet                   bool
-	whiteSet                   bool
 	lightcurve                 []float64
 	lcIndices                  []int
 	sysStartTimes              []time.Time
@@ -53,6 +51,11 @@ type Config struct {
 	sysDeadtimeSeconds         []float64
 	gapIndices                 []int
 	gapWidth                   []int
+	clockStepIndices           []int
+	clockStepSeconds           []float64
+	forcedClockSteps           map[int]bool
+	scannedFitsFilePaths       []string
+	scannedLightcurve          []float64
 	frameTimeSeconds           float64
 	expTimeSeconds             float64
 	dateErrSeconds             float64
@@ -60,7 +63,59 @@ type Config struct {
 	lightCurveStartIndex       int
 	lightCurveEndIndex         int
 	displayBuffer              []byte
-	workingBuffer              []byte
+	displayImage               *image.NRGBA // Wraps displayBuffer
+	frame                      *frameData   // Pixels of the current frame at full precision
+	imageView                  *imageView
+	imageDragMode              string // What a drag on the image does - see imageview.go
+	autoContrastRegion         string
+	autoBlackPercentile        float64
+	autoWhitePercentile        float64
+	autoContrastBox            image.Rectangle
+	cubeTimings                map[string]cubeTiming // Frame times of each cube in the folder - see cube.go
+	colorChannel               string                // What the lightcurve and photometry measure in a color frame - see color.go
+	frameCache                 *frameCache           // Decoded frames - see framecache.go
+	frameCacheMB               int                   // Memory limit of frameCache
+	cacheLabel                 *widget.Label         // Shows whether frames come from the cache while playing
+	pixelLabel                 *widget.Label         // Position and value of the pixel under the cursor
+	masterDark                 *masterFrame          // Master bias/dark - see calibration.go
+	masterFlat                 *masterFrame          // Master flat, normalized to 1
+	shownFrame                 *frameData            // What is on screen: myWin.frame, or frames combined from it - see stack.go
+	displayMode                string                // One of displayModes
+	runningFrames              int                   // Frames in a running mean/median
+	stacked                    *stackedImage         // The last loop range stacked
+	stackShown                 bool                  // The contrast sliders are set up for the stacked image
+	referencePath              string                // Subtracted in the difference from reference mode - see compare.go
+	blinking                   bool                  // The blink comparator is running
+	blinkRate                  float64               // Blinks per second
+	blinkIndexA                int                   // -1 when not set
+	blinkIndexB                int                   // -1 when not set
+	blinkFolderB               string                // When set, the current frame blinks against the same frame of this folder
+	blinkFolderBPaths          []string              // The FITS files of blinkFolderB
+	histogram                  *histogramView        // nil until the histogram panel is first shown - see histogram.go
+	histogramPanel             fyne.CanvasObject     // The histogram with its controls
+	histogramDock              *fyne.Container       // Holds histogramPanel when it is docked under the image
+	histogramWindow            fyne.Window           // Holds histogramPanel when it is floated
+	histogramDockButton        *widget.Button        // Float/Dock
+	histogramLabel             *widget.Label         // Percentage of pixels clipped
+	histogramLogScale          bool                  // Bar heights are log(1 + count)
+	histogramRegion            string                // histRegionFrame or histRegionROI
+	exportFormat               string                // One of exportFormats - see export.go
+	exportArea                 string                // exportAreaFrame or exportAreaROI
+	exportCaption              bool                  // Burn the frame number and timestamp into exported images
+	videoFormat                string                // One of videoFormats - see video.go
+	videoFPS                   float64               // Frame rate of exported videos
+	apertures                  []aperture            // Named measurement apertures of this folder - see apertures.go
+	apertureResults            *apertureResults      // The last measurement of the apertures
+	skyMethod                  string                // skyMedian or skyClippedMean - see photometry.go
+	photometryGain             float64               // Electrons per ADU, for the noise estimates
+	showAperturePaths          bool                  // Draw the aperture paths of the last measurement over the image
+	stretchName                string                // One of stretchNames
+	sqrtPower                  float64
+	logScale                   float64
+	asinhSoftening             float64
+	histEqStrength             float64
+	zscaleContrast             float64
+	zscaleSamples              int
 	bytesPerPixel              int
 	maxImg64                   float64
 	minImg64                   float32
@@ -86,6 +141,7 @@ type Config struct {
 	centerButton               *widget.Button
 	drawROIbutton              *widget.Button
 	roiCheckbox                *widget.Check
+	drawRoiCheckbox            *widget.Check
 	deletePathCheckbox         *widget.Check
 	addFlashTimestampsCheckbox *widget.Check
 	showFrameOnSliderMove      bool
@@ -120,18 +176,23 @@ type Config struct {
 	playBackMilliseconds       int64
 	currentFilePath            string
 	playDelay                  time.Duration
-	primaryHDU                 fitsio.HDU
 	timestamps                 []string
 	metaData                   [][]string
 	timestamp                  string
 	loopStartIndex             int
 	loopEndIndex               int
-	hist                       []int
+	interpolateDroppedFrames   bool
+	flashPlotWin               fyne.Window // The 'flash' lightcurve window while it is open - nil otherwise
+	mainMenu                   *fyne.MainMenu
+	bitpix                     int
+	writePlaceholderFrames     bool
+	numPlaceholderFrames       int
+	settingsSegments           []settingsSegment
 }
 
 const version = "1.6.5"
 
-const maxAllowedFlashLevel = 200.0
+const maxAllowedFlashLevel = 200.0 // Per pixel, for 8 bit data - see flashLevelLimit() for other formats
 
 const droppedFrameString = "droppedFrameString"
 
@@ -265,6 +326,7 @@ func main() {
 	w.Resize(fyne.Size{Height: 800, Width: 1200})
 
 	myWin.parentWindow = w
+	w.SetMainMenu(buildMainMenu())
 
 	sliderWhite := widget.NewSlider(0, 255)
 	sliderWhite.OnChanged = func(value float64) { displayFitsImage() }
@@ -278,11 +340,15 @@ func main() {
 	sliderBlack.OnChanged = func(value float64) { displayFitsImage() }
 	myWin.blackSlider = sliderBlack
 
-	rightItem := container.NewHBox(sliderBlack, sliderWhite)
+	loadAutoContrastSettings()
+	autoButton := widget.NewButton("Auto", func() { applyAutoContrast() })
+	rightItem := container.NewBorder(nil, autoButton, nil, nil, container.NewHBox(sliderBlack, sliderWhite))
 
 	leftItem := container.NewVBox()
 	leftItem.Add(widget.NewButton("Select fits folder", func() { chooseFitsFolder() }))
 	leftItem.Add(widget.NewButton("Show meta-data", func() { showMetaData() }))
+	leftItem.Add(widget.NewButton("Browse HDUs", func() { showHDUBrowser() }))
+	leftItem.Add(widget.NewButton("Dark/flat calibration", func() { showCalibrationWindow() }))
 	selector := widget.NewSelect([]string{"1 fps", "5 fps", "10 fps", "25 fps", "30 fps", "max"},
 		func(opt string) { setPlayDelay(opt) })
 	selector.PlaceHolder = "Set play fps"
@@ -290,6 +356,27 @@ func main() {
 	myWin.playDelay = 97 * time.Millisecond // 100 - 3
 	leftItem.Add(selector)
 
+	loadFrameCacheSettings()
+	loadStretchSettings()
+	stretchSelector := widget.NewSelect(stretchNames, nil)
+	stretchSelector.Selected = myWin.stretchName // Set directly so that nothing is displayed before a folder is open
+	stretchSelector.OnChanged = func(opt string) { selectStretch(opt) }
+	leftItem.Add(stretchSelector)
+	leftItem.Add(widget.NewButton("Stretch settings", func() { stretchSettingsEntry() }))
+	leftItem.Add(widget.NewButton("Auto-contrast settings", func() { autoContrastSettingsEntry() }))
+	loadHistogramSettings()
+	leftItem.Add(widget.NewButton("Histogram", func() { toggleHistogram() }))
+
+	loadDisplayModeSettings()
+	loadBlinkSettings()
+	displayModeSelector := widget.NewSelect(displayModes, nil)
+	displayModeSelector.Selected = myWin.displayMode
+	displayModeSelector.OnChanged = func(opt string) { selectDisplayMode(opt) }
+	runningFramesEntry := widget.NewEntry()
+	runningFramesEntry.SetText(strconv.Itoa(myWin.runningFrames))
+	runningFramesEntry.OnChanged = func(text string) { setRunningFrames(text) }
+	leftItem.Add(container.NewBorder(nil, nil, nil, runningFramesEntry, displayModeSelector))
+
 	leftItem.Add(widget.NewButton("Help", func() { showSplash() }))
 
 	// These are left in if somebody requests a white theme option using buttons
@@ -320,6 +407,8 @@ func main() {
 	leftItem.Add(myWin.roiCheckbox)
 	myWin.setRoiButton = widget.NewButton("Set ROI size", func() { roiEntry() })
 	leftItem.Add(myWin.setRoiButton)
+	myWin.drawRoiCheckbox = widget.NewCheck("Draw ROI on image", toggleDrawROI)
+	leftItem.Add(myWin.drawRoiCheckbox)
 
 	up := widget.NewButtonWithIcon("", theme.MoveUpIcon(), func() { moveRoiUp() })
 	down := widget.NewButtonWithIcon("", theme.MoveDownIcon(), func() { moveRoiDown() })
@@ -354,6 +443,9 @@ func main() {
 
 	myWin.drawROIbutton = widget.NewButton("Show ROI", func() { showROI() })
 	leftItem.Add(myWin.drawROIbutton)
+	loadPhotometrySettings()
+	leftItem.Add(widget.NewButton("Apertures", func() { showApertureWindow() }))
+	leftItem.Add(widget.NewButton("Export lightcurve csv", func() { exportLightcurveCSV(myWin.parentWindow) }))
 
 	disableRoiControls()
 
@@ -361,6 +453,11 @@ func main() {
 	leftItem.Add(widget.NewButton("Set loop start", func() { setLoopStart() }))
 	leftItem.Add(widget.NewButton("Set loop end", func() { setLoopEnd() }))
 	leftItem.Add(widget.NewButton("Run loop", func() { go runLoop() }))
+	leftItem.Add(widget.NewButton("Stack loop range", func() { stackLoopRange() }))
+	leftItem.Add(widget.NewButton("Compare frames", func() { showCompareWindow() }))
+	loadExportSettings()
+	loadVideoSettings()
+	leftItem.Add(widget.NewButton("Export frames", func() { showExportWindow() }))
 
 	myWin.fileLabel = widget.NewLabel("File name goes here")
 
@@ -382,7 +479,13 @@ func main() {
 	toolBar.Add(widget.NewButton("+1", func() { processForwardOneFrame() }))
 	toolBar.Add(layout.NewSpacer()) // To center the buttons (in conjunction with its "mate")
 
-	bottomItem := container.NewVBox(myWin.fileSlider, toolBar, row1, row2)
+	// The status labels are overlaid at the ends of the toolbar so that their changing text does not move the buttons
+	myWin.pixelLabel = widget.NewLabel("")
+	myWin.cacheLabel = widget.NewLabel("")
+	statusBar := container.NewBorder(nil, nil, myWin.pixelLabel, myWin.cacheLabel)
+
+	myWin.histogramDock = container.NewVBox() // Empty until the histogram is docked
+	bottomItem := container.NewVBox(myWin.histogramDock, myWin.fileSlider, container.NewStack(toolBar, statusBar), row1, row2)
 
 	centerItem := widget.NewLabel("") // Blank placeholder
 	centerContent := container.NewBorder(
@@ -454,50 +557,6 @@ func delayedExecution() {
 	}
 }
 
-func doXaxis(img, grayImage image.Image, xmax, y int) {
-	//trace("")
-	var oldColor color.Color
-	var newColor color.Gray
-	for x := 0; x < xmax; x++ {
-		oldColor = img.At(x, y) // This could be Gray|Gray16|Gray32|Gray64
-		newColor = color.GrayModel.Convert(oldColor).(color.Gray)
-		grayImage.(*image.Gray).Set(x, y, newColor)
-	}
-}
-
-func convertImageToGray(img image.Image) (grayImage image.Image) {
-	//start := time.Now()
-	//trace("")
-	bounds := img.Bounds()
-	grayImage = image.NewGray(bounds)
-	var wg sync.WaitGroup
-
-	for y := 0; y < bounds.Max.Y; y++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			doXaxis(img, grayImage, bounds.Max.X, y)
-		}()
-	}
-	wg.Wait()
-	//elapsed := time.Since(start)
-	//fmt.Printf("Execution time: %s\n", elapsed)
-	return grayImage
-}
-
-//func saveImageToFile(img image.Image, filename string) error {
-//	f, err := os.Create(filename)
-//	if err != nil {
-//		return err
-//	}
-//	defer f.Close()
-//
-//	if err := png.Encode(f, img); err != nil {
-//		return err
-//	}
-//	return nil
-//}
-
 func toggleAutoAddTimestampsCheckbox(_ bool) {
 	trace("")
 	myWin.App.Preferences().SetBool("EnableAutoTimestampInsertion", myWin.addFlashTimestampsCheckbox.Checked)
@@ -506,6 +565,34 @@ func toggleAutoAddTimestampsCheckbox(_ bool) {
 func addTimestampsToFitsFiles() {
 	trace("")
 
+	if cameraSettingsChanged() {
+		// The dead time and uncertainty calculations below assume a single exposure time
+		dialog.ShowInformation("Timestamp insertion refused", settingsChangeReport(), myWin.parentWindow)
+		return
+	}
+
+	if len(myWin.cubeTimings) > 0 {
+		dialog.ShowInformation("Timestamp insertion refused",
+			"Timestamps are written into individual frame files.\n"+
+				"The frames of a FITS cube cannot be timestamped.", myWin.parentWindow)
+		return
+	}
+	for _, frameFile := range myWin.fitsFilePaths {
+		if strings.HasSuffix(frameFile, ".fz") {
+			dialog.ShowInformation("Timestamp insertion refused",
+				"Timestamps cannot be written into compressed (.fz) files.\n"+
+					"Unpack them (funpack) first.", myWin.parentWindow)
+			return
+		}
+	}
+
+	if err := checkExposureTimesUnchanged(); err != nil {
+		// The dead time computed below would be wrong - and no file has been changed yet
+		log.Printf("\n%s\n", err)
+		dialog.ShowInformation("Timestamp insertion refused", err.Error(), myWin.parentWindow)
+		return
+	}
+
 	// All GUI folder selections get written to this variable, so there is no difference in the
 	// processing of a folder supplied on the command line and one selected via the GUI
 	readEdgeTimeFile(myWin.cmdLineFolder)
@@ -568,6 +655,9 @@ func addTimestampsToFitsFiles() {
 		myWin.timestamps = append(myWin.timestamps, tsStr)
 	} // Some of these may be skipped - those will be of the missing frames
 
+	myWin.frameCache.clear()    // The files are about to be rewritten
+	myWin.apertureResults = nil // Its timestamps are the DATE-OBS cards about to be replaced
+
 	k := 0 // Indexes through timeStamps
 	for _, frameFile := range myWin.fitsFilePaths {
 		if frameFile == droppedFrameString {
@@ -594,21 +684,7 @@ func addTimestampsToFitsFiles() {
 
 		hdu := fits.HDU(0)
 
-		exptimeCard := hdu.Header().Get("EXPTIME")
-		if exptimeCard == nil {
-			// A SharpCap capture always has an EXPTIME card. We depend on this, so
-			// cannot proceed if missing
-			log.Println("\nCould not find an EXPTIME card. This is required.")
-			return
-		}
-		myWin.expTimeSeconds, err = strconv.ParseFloat(fmt.Sprintf("%v", exptimeCard.Value), 64)
-		if err != nil {
-			log.Printf("\nCould not parse EXPTIME card: %+v\n", err)
-			return
-		}
-
-		myWin.deadTimeSeconds = myWin.frameTimeSeconds - myWin.expTimeSeconds
-		//fmt.Println(readingsBetweenGoalposts, timeBetweenGoalposts, myWin.deadTimeSeconds)
+		// EXPTIME was checked by checkExposureTimesUnchanged() before any file was opened for writing
 
 		dateObsCard := hdu.Header().Get("DATE-OBS")
 		if dateObsCard == nil {
@@ -787,6 +863,16 @@ func addTimestampsToFitsFiles() {
 
 		_ = fits.Close()
 	}
+	myWin.frameCache.clear() // Frames may have been read while the files were being rewritten
+	myWin.apertureResults = nil
+
+	placeholderMsg := ""
+	if myWin.writePlaceholderFrames {
+		numWritten := writeDroppedFramePlaceholders()
+		if numWritten > 0 {
+			placeholderMsg = fmt.Sprintf("%d placeholder files were written for dropped frames\n\n", numWritten)
+		}
+	}
 
 	msg := fmt.Sprintf("\nAll timestamps have been added to the file.\n\n"+
 		"edge uncertainties include a dead time of %0.3f ms\n\n"+
@@ -797,6 +883,7 @@ func addTimestampsToFitsFiles() {
 		myWin.leftGoalpostStats.totalTimeErr*1000,
 		myWin.rightGoalpostStats.totalTimeErr*1000,
 		myWin.dateErrSeconds*1000)
+	msg += placeholderMsg
 	dialog.ShowInformation("Add timestamps report:", msg, myWin.parentWindow)
 	closeLogFile()
 }
@@ -842,106 +929,77 @@ func processNewFolder() bool {
 	trace("")
 	startNewLogFile()
 	log.Printf("\nProcessing: %s\n", myWin.folderSelected)
+	log.Println(calibrationDescription())
+	loadApertures()
 	myWin.numDroppedFrames = 0
+	myWin.numPlaceholderFrames = 0
+	myWin.settingsSegments = []settingsSegment{}
 	myWin.sysStartTimes = []time.Time{}
 	myWin.lightcurve = []float64{}
 	myWin.expTimeSeconds = 0.0
-	myWin.showFrameOnSliderMove = false
+	myWin.sysEndTimes = []time.Time{}
 	myWin.fileSlider.Max = float64(len(myWin.fitsFilePaths) - 1)
-	for k, frameFile := range myWin.fitsFilePaths {
-		myWin.fileSlider.SetValue(float64(k))
-		f, err := os.OpenFile(frameFile, os.O_RDWR, 0644)
-		if err != nil {
-			log.Printf("could not open file: %+v", err)
-			return false
-		}
 
-		fits, err := fitsio.Open(f)
+	scanResults, err := scanFitsFolderWithProgress(myWin.fitsFilePaths)
+	if err != nil {
+		log.Printf("\n%s\n", err)
+		return false
+	}
 
-		if err != nil {
-			log.Printf("\nCould not open FITS file: %+v\n", err)
+	for k, result := range scanResults {
+		if result.err != nil {
+			log.Printf("\n%s\n", result.err)
+			dialog.ShowInformation("Folder read error", result.err.Error(), myWin.parentWindow)
 			return false
 		}
 
-		hdu := fits.HDU(0)
-
-		xAxisValue := hdu.Header().Get("NAXIS1").Value
-		myWin.numXpixels, err = strconv.ParseInt(fmt.Sprintf("%v", xAxisValue), 10, 64)
-
-		yAxisValue := hdu.Header().Get("NAXIS2").Value
-		myWin.numYpixels, err = strconv.ParseInt(fmt.Sprintf("%v", yAxisValue), 10, 64)
-
+		myWin.numXpixels = result.numXpixels
+		myWin.numYpixels = result.numYpixels
 		myWin.numPixels = myWin.numXpixels * myWin.numYpixels
-
-		// Our objective here is to get the card that contains the original SharpCap system frame start time. In an
-		// unprocessed folder, that will be a DATE-OBS card.
-		// For a folder that has aleady had GPS timestamps added, the original SharpCap DATE-OBS card
-		// has been renamed and preserved as an OBS-DATE card
-		var sysTimeCard *fitsio.Card
-		obsDateCard := hdu.Header().Get("OBS-DATE")
-
-		if obsDateCard == nil { // This is an unprocessed folder. The frame start time is in a DATE-OBS card.
-			sysTimeCard = hdu.Header().Get("DATE-OBS")
-			if sysTimeCard == nil {
-				// An original SharpCap capture always has a DATE-OBS card. We depend on this, so
-				// cannot proceed if missing.
-				log.Println("\nCould not find a DATE-OBS card. This is required.")
-				log.Fatal("\nCould not find a DATE-OBS card in FITS file. This is required.")
-			}
-		} else {
-			sysTimeCard = obsDateCard
-		}
+		myWin.bitpix = result.bitpix
 
 		// Exposure time is a critical value that we want always available, so we grab that
-		// value from the first fits file every time we open a fits folder.
+		// value from the first fits file every time we open a fits folder ...
 		if myWin.expTimeSeconds == 0.0 { // Set exposure time from first fits file
-			exposureCard := hdu.Header().Get("EXPTIME")
-			if exposureCard == nil {
-				// A SharpCap capture always has an EXPTIME card. We depend on this, so
-				// cannot proceed if missing
-				log.Println("\nCould not find an EXPTIME card. This is required.")
-				log.Fatal("\nCould not find a EXPTIME card in FITS file. This is required.")
-			}
-			myWin.expTimeSeconds, _ = strconv.ParseFloat(fmt.Sprintf("%v", exposureCard.Value), 64)
+			myWin.expTimeSeconds = result.settings.expTime
 		}
 
-		// At this point, the sysTimeCard holds the original frame start time
-
-		dateEndCard := hdu.Header().Get("DATE-END")
-		if dateEndCard == nil {
-			// A SharpCap capture always has a DATE-END card. We depend on this, so
-			// cannot proceed if missing
-			log.Println("\nCould not find a DATE-END card. This is required.")
-			log.Fatal("\nCould not find a DATE-END card in FITS file. This is required.")
+		// ... but every frame is checked for a change of exposure time, gain or binning. A placeholder
+		// has no GAIN or binning cards, so it would look like a change - it is left out.
+		if !result.placeholder {
+			addFrameSettings(k, result.settings)
 		}
 
-		sysTimeString := fmt.Sprintf("%v", sysTimeCard.Value) + "Z"
-		sysTime, err := time.Parse(time.RFC3339, sysTimeString)
-		if err != nil {
-			log.Printf("\nCould not parse sysTimeString %s: %+v\n", sysTimeString, err)
-			return false
-		}
-		myWin.sysStartTimes = append(myWin.sysStartTimes, sysTime)
+		myWin.sysStartTimes = append(myWin.sysStartTimes, result.sysStartTime)
+		myWin.sysEndTimes = append(myWin.sysEndTimes, result.sysEndTime)
 
-		sysTimeString = fmt.Sprintf("%v", dateEndCard.Value) + "Z"
-		sysTime, err = time.Parse(time.RFC3339, sysTimeString)
-		if err != nil {
-			log.Printf("\nCould not parse sysTimeString %s: %+v\n", sysTimeString, err)
-			return false
+		if result.placeholder {
+			// A dropped frame placeholder written on an earlier pass. It has no measurement.
+			myWin.numPlaceholderFrames += 1
+			myWin.lightcurve = append(myWin.lightcurve, math.NaN())
+			continue
 		}
-		myWin.sysEndTimes = append(myWin.sysEndTimes, sysTime)
-
-		// Compute lightcurve point
-		myWin.primaryHDU = hdu // Needed by pixelSum() as implicit argument
-		goImage := myWin.primaryHDU.(fitsio.Image).Image()
-		goImage = convertImageToGray(goImage)
-		myWin.lightcurve = append(myWin.lightcurve, pixelSum())
+		myWin.lightcurve = append(myWin.lightcurve, result.pixelSum)
 	}
 	myWin.showFrameOnSliderMove = true
 	myWin.fileSlider.SetValue(0.0)
 
 	myWin.flashIntensityValid = true
 
+	// Keep the frame list and lightcurve as read so that the dropped frame insertion can be redone
+	// if the flash spacing shows that a gap was really a clock step.
+	myWin.forcedClockSteps = map[int]bool{}
+	myWin.scannedFitsFilePaths = make([]string, len(myWin.fitsFilePaths))
+	copy(myWin.scannedFitsFilePaths, myWin.fitsFilePaths)
+	myWin.scannedLightcurve = make([]float64, len(myWin.lightcurve))
+	copy(myWin.scannedLightcurve, myWin.lightcurve)
+
+	if cameraSettingsChanged() {
+		log.Println("")
+		log.Println(settingsChangeReport())
+		dialog.ShowInformation("Camera settings report", settingsChangeReport(), myWin.parentWindow)
+	}
+
 	// At this point, we have the lightcurve computed assuming all frames are present and
 	// a list of the frame-to-frame time deltas that can be used to find dropped frames.
 
@@ -955,11 +1013,24 @@ func processNewFolder() bool {
 
 	flashFound := findFlashEdges() // Checks flash intensity at top of left and right goalposts
 
+	if flashFound && crossCheckGapsAgainstFlashSpacing() {
+		// Some 'gaps' were steps of the PC clock - redo the dropped frame insertion without them
+		redoDroppedFrameInsertion()
+		myWin.fileSlider.Max = float64(len(myWin.fitsFilePaths) - 1)
+		flashFound = findFlashEdges()
+	}
+
 	if !flashFound {
 		dialog.ShowInformation("Flash intensity report", "No flash goalposts found.", myWin.parentWindow)
 		return false
 	}
 
+	if len(myWin.clockStepIndices) != 0 {
+		log.Println("")
+		log.Println(clockStepReport())
+		dialog.ShowInformation("Clock step report", clockStepReport(), myWin.parentWindow)
+	}
+
 	if !myWin.flashIntensityValid {
 		dialog.ShowInformation("Flash intensity report", "Flash intensity is too bright.", myWin.parentWindow)
 	}
@@ -968,6 +1039,10 @@ func processNewFolder() bool {
 	if myWin.numDroppedFrames != 0 {
 		dialog.ShowInformation("Dropped frames report",
 			fmt.Sprintf("%d frames were dropped", myWin.numDroppedFrames), myWin.parentWindow)
+	} else if myWin.numPlaceholderFrames != 0 {
+		dialog.ShowInformation("Dropped frames report",
+			fmt.Sprintf("%d frames were dropped (placeholder files are present for them)",
+				myWin.numPlaceholderFrames), myWin.parentWindow)
 	}
 	showSysTimePlots()
 	showFlashLightcurve()
@@ -987,6 +1062,8 @@ func improveTimeStepAndDetectTimingErrors(haveLightcurve bool) (int, int, int) {
 	var newLightcurve []float64
 	numGaps := 0
 	numCadenceErrors := 0
+	myWin.clockStepIndices = []int{}
+	myWin.clockStepSeconds = []float64{}
 	for i := range myWin.sysTimeDeltaSeconds {
 		newFitsFilePaths = append(newFitsFilePaths, myWin.fitsFilePaths[i])
 		if haveLightcurve {
@@ -995,17 +1072,20 @@ func improveTimeStepAndDetectTimingErrors(haveLightcurve bool) (int, int, int) {
 		if isGoodFrame(myWin.sysTimeDeltaSeconds[i]) {
 			goodTimeSteps = append(goodTimeSteps, myWin.sysTimeDeltaSeconds[i])
 		} else {
-			// We have either dropped frame(s) or a cadence error (which are fatal)
-			if isDroppedFrame(myWin.sysTimeDeltaSeconds[i]) {
+			// We have either dropped frame(s), a cadence error (which are fatal) or a step of the PC clock
+			if isCadenceError(i) {
+				numCadenceErrors += 1
+			} else if isClockStep(i) {
+				recordClockStep(i) // No frames are missing - the timestamps just jumped
+			} else {
 				numFramesInGap := int(math.Round(myWin.sysTimeDeltaSeconds[i]/myWin.frameTimeSeconds)) - 1
 				for range numFramesInGap {
 					newFitsFilePaths = append(newFitsFilePaths, droppedFrameString)
-					newLightcurve = append(newLightcurve, -1000)
+					newLightcurve = append(newLightcurve, math.NaN()) // Masked - see isMissingSample()
 				}
 				numGaps += 1
 				myWin.gapIndices = append(myWin.gapIndices, i)
-			} else {
-				numCadenceErrors += 1
+				myWin.gapWidth = append(myWin.gapWidth, numFramesInGap)
 			}
 		}
 	}
@@ -1022,12 +1102,13 @@ func improveTimeStepAndDetectTimingErrors(haveLightcurve bool) (int, int, int) {
 
 	// Compute number of frames in each gap
 	var numDroppedFrames = 0
-	for _, gapIndex := range myWin.gapIndices {
-		numFramesInGap := int(math.Round(myWin.sysTimeDeltaSeconds[gapIndex]/myWin.frameTimeSeconds)) - 1
+	for _, numFramesInGap := range myWin.gapWidth {
 		numDroppedFrames += numFramesInGap
 	}
 
+	// Clock steps are not elapsed time, so they are removed from the span before the frame time is computed
 	observationTimeSpan := myWin.sysStartTimes[len(myWin.sysStartTimes)-1].Sub(myWin.sysStartTimes[0]).Seconds()
+	observationTimeSpan -= totalClockStepSeconds()
 	myWin.frameTimeSeconds = observationTimeSpan / float64(len(myWin.sysStartTimes)+numDroppedFrames-1)
 	//log.Println("\ntimeStepSeconds:", myWin.frameTimeSeconds, " (improved)")
 	log.Println("")
@@ -1050,7 +1131,8 @@ func initializeConfig(running bool) {
 
 	myWin.lightcurve = make([]float64, 0)
 	myWin.displayBuffer = nil
-	myWin.workingBuffer = nil
+	myWin.displayImage = nil
+	myWin.frame = nil
 	myWin.bytesPerPixel = 0
 	myWin.xJogSize = 20
 	myWin.yJogSize = 20
@@ -1063,6 +1145,13 @@ func initializeConfig(running bool) {
 	myWin.autoPlayEnabled = false
 	myWin.currentFilePath = ""
 	myWin.timestamps = nil
+	myWin.shownFrame = nil
+	myWin.stacked = nil
+	myWin.stackShown = false
+	myWin.referencePath = ""
+	myWin.blinking = false
+	myWin.blinkIndexA = -1
+	myWin.blinkIndexB = -1
 }
 
 type forcedVariant struct {
@@ -1112,46 +1201,61 @@ func displayFitsImage() fyne.CanvasObject {
 	//trace("")
 	myWin.fileLabel.SetText(myWin.fitsFilePaths[myWin.fileIndex])
 
-	// A side effect of the next call is that myWin.displayBuffer is filled.
-	imageToUse, _, timestamp := getFitsImageFromFilePath(myWin.fitsFilePaths[myWin.fileIndex])
+	frame, _, timestamp := getFitsImageFromFilePath(myWin.fitsFilePaths[myWin.fileIndex])
 
-	if imageToUse == nil {
+	if frame == nil {
 		myWin.timestampLabel.Text = ""
 		return nil
 	}
 
 	myWin.timestampLabel.Text = timestamp
 
+	if myWin.stackShown {
+		// Back from the stacked image to frames
+		myWin.stackShown = false
+		setContrastSliderRange(frame)
+		myWin.adjustSliders = true
+	}
+
+	return showFrame(displayedFrame(frame))
+}
+
+func showFrame(frame *frameData) fyne.CanvasObject {
+	// Stretches frame into the display buffer and shows it
+	myWin.shownFrame = frame
+	if frame.width != myWin.imageWidth || frame.height != myWin.imageHeight {
+		// Not the size of the first frame (an extension picked in the HDU browser, say)
+		myWin.imageWidth = frame.width
+		myWin.imageHeight = frame.height
+		makeDisplayBuffer(myWin.imageWidth, myWin.imageHeight)
+		setContrastSliderRange(frame)
+		myWin.adjustSliders = true
+		myWin.imageView.resetZoom()
+	}
+
 	if myWin.whiteSlider != nil {
 		if myWin.adjustSliders {
-			if !myWin.whiteSet {
-				setSlider(myWin.hist, 75, "white")
-				myWin.whiteSet = true
-			}
-			if !myWin.blackSet {
-				setSlider(myWin.hist, 75, "black")
-				myWin.blackSet = true
-				myWin.adjustSliders = false
-			}
+			myWin.adjustSliders = false
+			autoContrast(frame)
 		}
-		// set displayBuffer from imageToUse stretched according to contrast sliders
-		applyContrastControls(imageToUse.Image.(*image.Gray).Pix, myWin.displayBuffer)
+		// set displayBuffer (the pixels of myWin.displayImage) from the frame stretched according to contrast sliders
+		applyContrastControls(frame, myWin.displayBuffer)
+		updateHistogram(frame)
 	}
 
-	myWin.fitsImages[0].Image.(*image.Gray).Pix = myWin.displayBuffer
-
 	if !myWin.roiActive {
 		restoreRect()
 	} else {
 		setROIrect()
 	}
+	myWin.imageView.applyZoom()
 
-	myWin.centerContent.Objects[0] = myWin.fitsImages[0]
+	myWin.centerContent.Objects[0] = myWin.imageView
 
 	myWin.centerContent.Refresh()
 	myWin.waitingForFileRead = false // Signal to anyone waiting for file read completion
 
-	return imageToUse
+	return myWin.imageView
 }
 
 func openFitsFile(fitsFilePath string) *fitsio.File {
@@ -1181,43 +1285,53 @@ func openFitsFile(fitsFilePath string) *fitsio.File {
 
 func initializeImages() {
 	trace("")
-	// side effect: myWin.primaryHDU is set
-	fitsImage, _, _ := getFitsImageFromFilePath(myWin.fitsFilePaths[0])
+	// side effect: myWin.frame is set
+	frame, _, _ := getFitsImageFromFilePath(myWin.fitsFilePaths[0])
 
-	if fitsImage == nil {
+	if frame == nil {
 		return
 	}
 
 	myWin.adjustSliders = true
-	myWin.blackSet = false
-	myWin.whiteSet = false
 
-	myWin.imageWidth = fitsImage.Image.Bounds().Max.X
-	myWin.imageHeight = fitsImage.Image.Bounds().Max.Y
+	myWin.imageWidth = frame.width
+	myWin.imageHeight = frame.height
 
-	myWin.fitsImages = append(myWin.fitsImages, fitsImage)
-
-	goImage := myWin.primaryHDU.(fitsio.Image).Image()
-	goImage = convertImageToGray(goImage)
-
-	myWin.bytesPerPixel = 1
+	myWin.bytesPerPixel = 4 // NRGBA so that invalid pixels can be shown in color
 
 	makeDisplayBuffer(myWin.imageWidth, myWin.imageHeight)
 
+	fitsImage := canvas.NewImageFromImage(myWin.displayImage) // This is a Fyne image
+	fitsImage.FillMode = canvas.ImageFillContain
+	myWin.fitsImages = append(myWin.fitsImages, fitsImage)
+	myWin.imageView = newImageView(myWin.fitsImages[0])
+
+	setContrastSliderRange(frame)
+	if frame.hasDataRange() {
+		// The file tells us its data range, so that is the starting contrast rather than percentiles
+		myWin.blackSlider.Value = frame.dataMin
+		myWin.whiteSlider.Value = frame.dataMax
+		myWin.adjustSliders = false
+	}
+
 	myWin.fileSlider.SetValue(0)
 	myWin.lightcurve = make([]float64, 0)
 }
 
-func histogram(sample []byte, stride, cornerRow, cornerCol, size int) (hist []int) {
-	//trace("")
-	hist = make([]int, 256)
-	for row := cornerRow; row < cornerRow+size; row++ {
-		for col := cornerCol; col < cornerCol+size; col++ {
-			k := row*stride + col
-			hist[sample[k]] += 1
-		}
+func setContrastSliderRange(frame *frameData) {
+	// The contrast sliders are in ADU (pixel values with BZERO/BSCALE applied), so their range
+	// follows the data type of the frame.
+	step := 1.0
+	if frame.bitpix < 0 {
+		step = (frame.nominalHi - frame.nominalLo) / 1000
+	}
+	for _, slider := range []*widget.Slider{myWin.blackSlider, myWin.whiteSlider} {
+		slider.Min = frame.nominalLo
+		slider.Max = frame.nominalHi
+		slider.Step = step
+		slider.Value = math.Max(frame.nominalLo, math.Min(frame.nominalHi, slider.Value))
+		slider.Refresh()
 	}
-	return hist
 }
 
 func reportROIsettings() {
@@ -1228,71 +1342,9 @@ func reportROIsettings() {
 	log.Printf("x0: %d  y0: %d  x1: %d  y1: %d\n\n", myWin.x0, myWin.y0, myWin.x1, myWin.y1)
 }
 
-func setSlider(hist []int, targetPercent int, sliderToSet string) {
-	//trace("")
-	// Compute the pixel count (requiredPixelSum) we want the standard deviation bars to enclose
-	totalPixelCount := 0
-	for i := 0; i < len(hist); i++ {
-		totalPixelCount += hist[i]
-	}
-	requiredPixelSum := totalPixelCount * targetPercent / 100
-
-	// Find the index of the histogram peak value
-	indexOfPeak := 0
-	peakValue := 0
-	for i := 0; i < len(hist); i++ {
-		if hist[i] > peakValue {
-			peakValue = hist[i]
-			indexOfPeak = i
-		}
-	}
-	//fmt.Printf("Peak value is %d at %d Need %d\n", peakValue, indexOfPeak, requiredPixelSum)
-
-	// standard deviation calculation - sum of hist around peak must exceed requiredPixelSum
-	stdLeft := indexOfPeak
-	stdRight := indexOfPeak
-	stdSum := peakValue
-	keepGoing := true
-	for keepGoing {
-		if stdLeft > 0 {
-			stdLeft -= 1
-			stdSum += hist[stdLeft]
-		}
-		if stdRight < len(hist)-1 {
-			stdRight += 1
-			stdSum += hist[stdRight]
-		}
-		keepGoing = stdSum <= requiredPixelSum
-	}
-	//fmt.Printf("stdLeft: %d  stdRight: %d\n", stdLeft, stdRight)
-
-	// Calculate slider position
-	stdWidth := stdRight - stdLeft
-	if stdWidth < 2 {
-		stdWidth = 2
-	}
-	blackLevel := indexOfPeak - stdWidth
-	if blackLevel < 0 {
-		blackLevel = 0
-	}
-	whiteLevel := indexOfPeak + 6*stdWidth
-	if whiteLevel > 255 {
-		whiteLevel = 255
-	}
-	if sliderToSet == "black" {
-		myWin.blackSlider.SetValue(float64(blackLevel))
-		//fmt.Printf("Set black slider to %d\n", blackLevel)
-	}
-	if sliderToSet == "white" {
-		myWin.whiteSlider.SetValue(float64(whiteLevel))
-		//fmt.Printf("Set white slider to %d\n", whiteLevel)
-	}
-	//fmt.Printf("blackLevel: %d  whiteLevel: %d\n", blackLevel, whiteLevel)
-}
-
-func getFitsImageFromFilePath(filePath string) (*canvas.Image, []string, string) {
+func getFitsImageFromFilePath(filePath string) (*frameData, []string, string) {
 	//trace("")
-	// An important side effect of this function: it fills the myWin.displayBuffer []byte
+	// An important side effect of this function: it sets myWin.frame and myWin.timestamp
 
 	if filePath == droppedFrameString {
 		myWin.centerContent.Objects[0] = canvas.NewRectangle(color.Black)
@@ -1300,38 +1352,23 @@ func getFitsImageFromFilePath(filePath string) (*canvas.Image, []string, string)
 		return nil, nil, ""
 	}
 
-	f := openFitsFile(filePath)
-	myWin.primaryHDU = f.HDU(0)
-	metaData, timestamp := formatMetaData(myWin.primaryHDU)
-
-	closeErr := f.Close()
-	if closeErr != nil {
-		errMsg := fmt.Errorf("could not close %s: %w", filePath, closeErr)
-		log.Printf(errMsg.Error())
-	}
-
-	goImage := myWin.primaryHDU.(fitsio.Image).Image()
-	goImage = convertImageToGray(goImage)
-
-	if myWin.adjustSliders {
-		// Calculate coordinates of sampling aperture for histogram
-		imageWidth := myWin.imageWidth
-		imageHeight := myWin.imageHeight
-		centerRow := imageHeight / 2
-		centerCol := imageWidth / 2
-		halfSize := 50
-		cornerRow := centerRow - halfSize
-		cornerCol := centerCol - halfSize
-
-		myWin.hist = histogram(goImage.(*image.Gray).Pix, goImage.(*image.Gray).Stride, cornerRow, cornerCol, halfSize*2)
-	}
-
-	if goImage == nil {
-		dialog.ShowInformation("Oops", "No images are present in the .fits file", myWin.parentWindow)
-		return nil, []string{}, ""
+	// Usually already decoded by the prefetcher while playing (see framecache.go)
+	entry, hit, err := myWin.frameCache.get(filePath)
+	if err != nil {
+		myWin.waitingForFileRead = false
+		if errors.Is(err, errNoImage) {
+			dialog.ShowInformation("Oops", "No images are present in the .fits file", myWin.parentWindow)
+			return nil, []string{}, ""
+		}
+		log.Println(err)
+		return nil, nil, ""
 	}
+	showCacheStatus(hit)
 
-	fitsImage := canvas.NewImageFromImage(goImage) // This is a Fyne image
+	frame := entry.frame
+	myWin.frame = frame
+	myWin.timestamp = entry.timestamp
+	myWin.timestampLabel.Text = myWin.timestamp
 
 	if myWin.buildLightcurve {
 		myWin.lightcurve = append(myWin.lightcurve, pixelSum())
@@ -1339,36 +1376,82 @@ func getFitsImageFromFilePath(filePath string) (*canvas.Image, []string, string)
 		//fmt.Printf("fileIndex: %d\n", myWin.fileIndex)
 	}
 
-	validateROIsize(goImage)
+	validateROIsize(frame.width, frame.height)
+
+	return frame, entry.metaData, entry.timestamp
+}
 
-	if myWin.roiActive {
+var errNoImage = errors.New("no images are present")
 
-		roi := goImage.(*image.Gray).SubImage(image.Rect(myWin.x0, myWin.y0, myWin.x1, myWin.y1))
+func loadFrame(filePath string) (*frameData, []string, string, error) {
+	// Reads, decodes and calibrates a frame with its meta-data and timestamp. This touches no myWin
+	// state other than the color channel and calibration settings, so the prefetcher can call it
+	// from its own goroutine.
+	frame, metaData, timestamp, err := readFrameFile(filePath)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return calibrateFrame(frame), metaData, timestamp, nil
+}
 
-		fitsImage = canvas.NewImageFromImage(roi)                                  // This is a Fyne image
-		myWin.workingBuffer = make([]byte, len(fitsImage.Image.(*image.Gray).Pix)) // workingBuffer <- fitsImage
-		copy(myWin.workingBuffer, fitsImage.Image.(*image.Gray).Pix)               // workingBuffer <- fitsImage
-		copy(myWin.displayBuffer, fitsImage.Image.(*image.Gray).Pix)               // displayBuffer <- fitsImage
+func readFrameFile(filePath string) (*frameData, []string, string, error) {
+	// loadFrame() without the calibration - for reading the calibration frames themselves
+	var frame *frameData
+	var metaData []string
+	var timestamp string
 
-		if myWin.roiChanged {
-			myWin.roiChanged = false
-			myWin.fitsImages[0] = fitsImage
-			myWin.centerContent.Objects[0] = fitsImage
+	if cubePath, plane, isPlane := parseCubePlaneRef(filePath); isPlane {
+		// One frame of a cube - only that plane is read (see cube.go)
+		header, planeFrame, err := readCubePlane(cubePath, plane)
+		if err != nil {
+			return nil, nil, "", err
 		}
-	}
+		frame = planeFrame
+		metaData, timestamp = formatCubePlaneMetaData(header, cubePath, plane)
+	} else if strings.HasSuffix(filePath, ".fz") {
+		// Tile compressed (fpack) - the image is in an extension (see hdu.go and tilecompress.go)
+		imageFrame, header, err := readFirstImage(filePath)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		frame = imageFrame
+		metaData, timestamp = formatHeaderMetaData(header)
+	} else {
+		f := openFitsFile(filePath)
+		if f == nil {
+			return nil, nil, "", fmt.Errorf("could not open %s", filePath)
+		}
+		primaryHDU := f.HDU(0)
+		metaData, timestamp = formatMetaData(primaryHDU)
 
-	if !myWin.roiActive {
-		copy(myWin.workingBuffer, fitsImage.Image.(*image.Gray).Pix)
+		closeErr := f.Close()
+		if closeErr != nil {
+			errMsg := fmt.Errorf("could not close %s: %w", filePath, closeErr)
+			log.Printf(errMsg.Error())
+		}
+
+		frame = frameDataFromHDU(primaryHDU)
+		if frame == nil {
+			// An empty primary HDU - the image may be in an extension
+			imageFrame, header, err := readFirstImage(filePath)
+			if err == nil {
+				frame = imageFrame
+				metaData, timestamp = formatHeaderMetaData(header)
+			}
+		}
 	}
 
-	fitsImage.FillMode = canvas.ImageFillContain
-	return fitsImage, metaData, timestamp
+	if frame == nil {
+		return nil, nil, "", fmt.Errorf("%s: %w", filePath, errNoImage)
+	}
+	return frame, metaData, timestamp, nil
 }
 
 func makeDisplayBuffer(width, height int) {
 	//trace("")
 	myWin.displayBuffer = make([]byte, width*height*myWin.bytesPerPixel)
-	myWin.workingBuffer = make([]byte, width*height*myWin.bytesPerPixel)
+	myWin.displayImage = &image.NRGBA{Pix: myWin.displayBuffer, Stride: width * myWin.bytesPerPixel,
+		Rect: image.Rect(0, 0, width, height)}
 	// Diagnostic print ...
 	//fmt.Printf("makeDisplayBuffer() made %d*%d*%d display buffer\n",
 	//	width, height, myWin.bytesPerPixel)
@@ -1380,6 +1463,7 @@ func formatMetaData(primaryHDU fitsio.HDU) ([]string, string) {
 	var metaDataText []string
 	var line string
 	timestampFound := false
+	timestamp := "<no timestamp found>"
 
 	for i := 0; i < len(primaryHDU.Header().Keys()); i += 1 {
 		card := primaryHDU.(fitsio.Image).Header().Card(i)
@@ -1393,18 +1477,12 @@ func formatMetaData(primaryHDU fitsio.HDU) ([]string, string) {
 		}
 		if card.Name == "DATE-OBS" && !timestampFound { // Use first DATE-OBS card found as timestamp
 			timestampFound = true
-			myWin.timestamp = fmt.Sprintf("%v", card.Value)
-			myWin.timestamp = strings.Replace(myWin.timestamp, "T", " ", 1)
-			myWin.timestampLabel.Text = myWin.timestamp
+			timestamp = fmt.Sprintf("%v", card.Value)
+			timestamp = strings.Replace(timestamp, "T", " ", 1)
 		}
 	}
 
-	if !timestampFound {
-		myWin.timestamp = "<no timestamp found>"
-		myWin.timestampLabel.Text = myWin.timestamp
-	}
-
-	return metaDataText, myWin.timestamp
+	return metaDataText, timestamp
 }
 
 func getFitsFilenames(folder string) []string {
@@ -1417,7 +1495,7 @@ func getFitsFilenames(folder string) []string {
 	for i := 0; i < len(entries); i += 1 {
 		if !entries[i].IsDir() {
 			name := entries[i].Name()
-			if strings.HasSuffix(name, ".fits") {
+			if strings.HasSuffix(name, ".fits") || strings.HasSuffix(name, ".fits.fz") {
 				if !strings.HasSuffix(folder, "\\") {
 					fitsPaths = append(fitsPaths, folder+"\\"+name)
 				} else {
@@ -1426,50 +1504,94 @@ func getFitsFilenames(folder string) []string {
 			}
 		}
 	}
+	fitsPaths = expandCubes(fitsPaths)
+	myWin.frameCache.clear()
 	myWin.numFiles = len(fitsPaths) + myWin.numDroppedFrames
 	myWin.fileSlider.Max = float64(myWin.numFiles - 1)
 	myWin.fileSlider.Min = 0.0
 	return fitsPaths
 }
 
-func applyContrastControls(original, stretched []byte) {
+// Invalid pixels are drawn in this color so that they cannot be mistaken for dark or saturated sky
+var invalidPixelColor = color.NRGBA{R: 255, G: 0, B: 255, A: 255}
+
+func contrastLevels(statsPixels []float64) (bot, top float64, invert bool) {
+	// The ADU values shown as black and white (bot <= top), and whether the image is inverted
+	bot = myWin.blackSlider.Value
+	top = myWin.whiteSlider.Value
+	if myWin.stretchName == "zscale" {
+		// zscale picks the levels itself - the sliders only choose whether the image is inverted
+		z1, z2 := zscale(statsPixels, myWin.zscaleContrast, myWin.zscaleSamples)
+		if bot > top {
+			bot, top = z2, z1
+		} else {
+			bot, top = z1, z2
+		}
+	}
+	invert = bot > top
+	if invert {
+		bot, top = top, bot
+	}
+	return bot, top, invert
+}
+
+func applyContrastControls(frame *frameData, stretched []byte) {
 	//trace("")
-	// stretched is modified.    original is untouched.
-	var floatVal float64
+	// stretched is modified.    frame is untouched.
+	// frame is in ADU, the slider values are in ADU - only stretched is 8 bit (NRGBA).
+	// A color frame has the same stretch applied to each of its planes.
 	var scale float64
+	original := frame.pix
 
-	if len(original) > len(stretched) { // This should never happen - it's a coding error
-		msg := fmt.Sprintf("input length: %d bytes  output length: %d bytes\n", len(original), len(stretched))
+	if len(original)*4 > len(stretched) { // This should never happen - it's a coding error
+		msg := fmt.Sprintf("input length: %d pixels  output length: %d bytes (4 per pixel)\n", len(original), len(stretched))
 		dialog.ShowInformation("Oops - programming error", msg, myWin.parentWindow)
 		return
 	}
 
-	bot := myWin.blackSlider.Value
-	top := myWin.whiteSlider.Value
-
-	invert := bot > top
-	if top > bot {
-		scale = 255 / (top - bot)
-	} else {
-		scale = 255 / (bot - top)
-		temp := bot
-		bot = top
-		top = temp
+	if frame.signed {
+		applyDivergingStretch(frame, stretched)
+		return
 	}
 
-	for i := 0; i < len(original); i++ {
-		if float64(original[i]) <= bot {
-			stretched[i] = 0
-		} else if float64(original[i]) > top {
-			stretched[i] = 255
+	statsPixels := statsRegionPixels(original)
+	bot, top, invert := contrastLevels(statsPixels)
+	scale = 255 / (top - bot)
+	curve := stretchCurve(statsPixels, bot, top)
+
+	stretchValue := func(value float64) byte {
+		var level byte
+		if value <= bot {
+			level = 0
+		} else if value > top {
+			level = 255
+		} else if curve != nil {
+			level = curve[int((value-bot)/(top-bot)*stretchCurveSize)]
 		} else {
-			floatVal = scale * (float64(original[i]) - bot)
-			intVal := int(math.Round(floatVal))
-			stretched[i] = byte(intVal)
+			level = byte(int(math.Round(scale * (value - bot))))
 		}
 		if invert {
-			stretched[i] = ^stretched[i]
+			level = ^level
+		}
+		return level
+	}
+
+	for i := 0; i < len(original); i++ {
+		if frame.isInvalid(i) { // Invalid pixel (BLANK or NaN)
+			copy(stretched[4*i:4*i+4], []byte{invalidPixelColor.R, invalidPixelColor.G, invalidPixelColor.B, 255})
+			continue
+		}
+		if frame.isColor() {
+			stretched[4*i] = stretchValue(frame.red[i])
+			stretched[4*i+1] = stretchValue(frame.green[i])
+			stretched[4*i+2] = stretchValue(frame.blue[i])
+		} else {
+			level := stretchValue(original[i])
+			stretched[4*i] = level
+			stretched[4*i+1] = level
+			stretched[4*i+2] = level
 		}
+		stretched[4*i+3] = 255
 	}
 	return
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fyne.io/fyne/v2"
+)
+
+func buildMainMenu() *fyne.MainMenu {
+	myWin.interpolateDroppedFrames = myWin.App.Preferences().BoolWithFallback("InterpolateDroppedFrames", false)
+	interpolateItem := fyne.NewMenuItem("Show dropped frames as interpolated values in plots", nil)
+	interpolateItem.Checked = myWin.interpolateDroppedFrames
+	interpolateItem.Action = func() {
+		myWin.interpolateDroppedFrames = !myWin.interpolateDroppedFrames
+		interpolateItem.Checked = myWin.interpolateDroppedFrames
+		myWin.App.Preferences().SetBool("InterpolateDroppedFrames", myWin.interpolateDroppedFrames)
+		myWin.mainMenu.Refresh()
+		refreshFlashLightcurve()
+	}
+
+	myWin.writePlaceholderFrames = myWin.App.Preferences().BoolWithFallback("WritePlaceholderFrames", false)
+	placeholderItem := fyne.NewMenuItem("Write placeholder FITS files for dropped frames", nil)
+	placeholderItem.Checked = myWin.writePlaceholderFrames
+	placeholderItem.Action = func() {
+		myWin.writePlaceholderFrames = !myWin.writePlaceholderFrames
+		myWin.App.Preferences().SetBool("WritePlaceholderFrames", myWin.writePlaceholderFrames)
+		placeholderItem.Checked = myWin.writePlaceholderFrames
+		myWin.mainMenu.Refresh()
+	}
+
+	myWin.colorChannel = myWin.App.Preferences().StringWithFallback("ColorChannel", channelLuminance)
+	channelMenu := fyne.NewMenu("")
+	for _, channel := range colorChannels {
+		channelItem := fyne.NewMenuItem(channel, nil)
+		channelItem.Checked = channel == myWin.colorChannel
+		channelItem.Action = func() {
+			myWin.colorChannel = channel
+			myWin.App.Preferences().SetString("ColorChannel", myWin.colorChannel)
+			for _, item := range channelMenu.Items {
+				item.Checked = item.Label == myWin.colorChannel
+			}
+			myWin.mainMenu.Refresh()
+			myWin.frameCache.clear() // The cached frames were measured in the old channel
+			if len(myWin.fitsImages) > 0 {
+				displayFitsImage()
+			}
+		}
+		channelMenu.Items = append(channelMenu.Items, channelItem)
+	}
+	channelItem := fyne.NewMenuItem("Color channel to measure", nil)
+	channelItem.ChildMenu = channelMenu
+
+	cacheItem := fyne.NewMenuItem("Frame cache size...", func() { frameCacheSettingsEntry() })
+
+	optionsMenu := fyne.NewMenu("Options", interpolateItem, placeholderItem, channelItem, cacheItem)
+
+	myWin.mainMenu = fyne.NewMainMenu(optionsMenu)
+	return myWin.mainMenu
+}
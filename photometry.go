@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+	"math"
+	"slices"
+)
+
+// Circular apertures with a sky annulus. The sky level is the median (or sigma-clipped mean) of the
+// annulus pixels, and the flux is the aperture sum less the sky level times the number of aperture
+// pixels. The noise of the flux comes from the CCD equation:
+//
+//	noise^2 = flux/gain + n * skySigma^2 * (1 + n/nSky)
+//
+// with n aperture pixels, nSky annulus pixels and gain in electrons per ADU. A pixel belongs to a
+// circle when its center is inside it - there is no partial pixel weighting.
+
+const shapeRectangle = "rectangle"
+const shapeCircle = "circle"
+
+const skyMedian = "median"
+const skyClippedMean = "sigma-clipped mean"
+
+var skyMethods = []string{skyMedian, skyClippedMean}
+
+const clipSigma = 3.0
+const maxClipIterations = 10
+
+func loadPhotometrySettings() {
+	prefs := myWin.App.Preferences()
+	myWin.skyMethod = prefs.StringWithFallback("SkyMethod", skyMedian)
+	myWin.photometryGain = prefs.FloatWithFallback("PhotometryGain", 1.0)
+}
+
+type photometry struct {
+	flux     float64 // Background subtracted for a circle, the plain sum for a rectangle
+	sky      float64 // Per pixel - NaN for a rectangle
+	noise    float64 // NaN for a rectangle (there is no sky to estimate it from)
+	numPix   int
+	numSky   int
+	skySigma float64
+}
+
+func circlePixels(frame *frameData, cx, cy, inner, outer float64) []float64 {
+	// The valid pixels whose centers are more than inner and at most outer from cx, cy.
+	// An inner radius < 0 includes the center pixel.
+	var values []float64
+	x0 := max(0, int(math.Floor(cx-outer)))
+	x1 := min(frame.width-1, int(math.Ceil(cx+outer)))
+	y0 := max(0, int(math.Floor(cy-outer)))
+	y1 := min(frame.height-1, int(math.Ceil(cy+outer)))
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			dx := float64(x) + 0.5 - cx
+			dy := float64(y) + 0.5 - cy
+			d2 := dx*dx + dy*dy
+			if d2 > outer*outer || (inner >= 0 && d2 <= inner*inner) {
+				continue
+			}
+			if value := frame.at(x, y); !math.IsNaN(value) {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func meanAndSigma(values []float64) (mean, sigma float64) {
+	for _, value := range values {
+		mean += value
+	}
+	mean /= float64(len(values))
+	for _, value := range values {
+		sigma += (value - mean) * (value - mean)
+	}
+	if len(values) > 1 {
+		sigma = math.Sqrt(sigma / float64(len(values)-1))
+	}
+	return mean, sigma
+}
+
+func skyLevel(values []float64) (level, sigma float64) {
+	// The sky per pixel and the scatter of the sky pixels. values is sorted in place.
+	if len(values) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	if myWin.skyMethod == skyClippedMean {
+		kept := values
+		for i := 0; i < maxClipIterations; i++ {
+			mean, sigma := meanAndSigma(kept)
+			var next []float64
+			for _, value := range kept {
+				if math.Abs(value-mean) <= clipSigma*sigma {
+					next = append(next, value)
+				}
+			}
+			if len(next) == len(kept) || len(next) < 2 {
+				break
+			}
+			kept = next
+		}
+		return meanAndSigma(kept)
+	}
+	level = median(values)
+	deviations := make([]float64, len(values))
+	for i, value := range values {
+		deviations[i] = math.Abs(value - level)
+	}
+	slices.Sort(deviations)
+	return level, 1.4826 * median(deviations) // The MAD scaled to a gaussian sigma
+}
+
+func measureCircle(frame *frameData, a aperture) photometry {
+	inAperture := circlePixels(frame, a.CenterX, a.CenterY, -1, a.Radius)
+	inSky := circlePixels(frame, a.CenterX, a.CenterY, a.SkyInner, a.SkyOuter)
+	result := photometry{numPix: len(inAperture), numSky: len(inSky)}
+	if len(inAperture) == 0 {
+		return photometry{flux: math.NaN(), sky: math.NaN(), noise: math.NaN()}
+	}
+	sum := 0.0
+	for _, value := range inAperture {
+		sum += value
+	}
+	result.sky, result.skySigma = skyLevel(inSky)
+	result.flux = sum - float64(result.numPix)*result.sky
+	n := float64(result.numPix)
+	variance := max(result.flux, 0)/myWin.photometryGain +
+		n*result.skySigma*result.skySigma*(1+n/float64(max(result.numSky, 1)))
+	result.noise = math.Sqrt(variance)
+	return result
+}
+
+func measureAperture(frame *frameData, a aperture) photometry {
+	if a.Shape == shapeCircle {
+		return measureCircle(frame, a)
+	}
+	return photometry{flux: apertureSum(frame, a.rect()), sky: math.NaN(), noise: math.NaN()}
+}
+
+type errorPoints struct {
+	plotter.XYs
+	plotter.YErrors
+}
+
+func buildAperturePlot(results *apertureResults, i int, fileName string) {
+	// buildPlot() for one aperture, with error bars from the noise estimates when there are any
+	a := results.apertures[i]
+	var points errorPoints
+	for k, value := range results.curves[i] {
+		if isMissingSample(value) {
+			continue
+		}
+		points.XYs = append(points.XYs, plotter.XY{X: float64(k), Y: value})
+		noise := results.noise[i][k]
+		if math.IsNaN(noise) {
+			noise = 0
+		}
+		points.YErrors = append(points.YErrors, struct{ Low, High float64 }{noise, noise})
+	}
+
+	plot.DefaultFont = font.Font{Typeface: "Liberation", Variant: "Sans", Style: 0, Weight: 3, Size: font.Points(20)}
+
+	plt := plot.New()
+	plt.X.Min = 0
+	plt.X.Max = float64(len(results.paths))
+	plt.Title.Text = fmt.Sprintf("%s (%s) lightcurve", a.Name, a.Role)
+	plt.X.Label.Text = "frame index"
+	plt.Y.Label.Text = "intensity"
+	if a.Shape == shapeCircle {
+		plt.Y.Label.Text = "flux (sky subtracted)"
+	}
+
+	plotutil.DefaultGlyphShapes[0] = plotutil.Shape(5) // set point shape to filled circle
+
+	err := plotutil.AddScatters(plt, points.XYs)
+	if err != nil {
+		panic(err)
+	}
+	if a.Shape == shapeCircle && len(points.XYs) > 0 {
+		errorBars, err := plotter.NewYErrorBars(points)
+		if err != nil {
+			panic(err)
+		}
+		plt.Add(errorBars)
+	}
+
+	err = plt.Save(21*vg.Inch, 6*vg.Inch, fileName)
+	if err != nil {
+		panic(err)
+	}
+}
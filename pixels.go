@@ -0,0 +1,259 @@
+package main
+
+import (
+	"FITSreader/fitsio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// frameData holds the pixels of one frame as physical values (BZERO and BSCALE applied) at full
+// precision, whatever the BITPIX of the file. Everything that looks at pixel values (contrast
+// stretch, histogram, ROI) works from this. Only the final display is quantized to 8 bits.
+// Invalid pixels (NaN in the file, or equal to BLANK in integer data) are NaN here, so that anything
+// that compares or sums values must skip them.
+type frameData struct {
+	width     int
+	height    int
+	bitpix    int
+	pix       []float64 // Row-major, width*height values. For a color frame, the channel selected for measurement.
+	red       []float64 // Color frames only (RGB cube or debayered) - nil for monochrome
+	green     []float64
+	blue      []float64
+	nominalLo float64 // The range of values the file format can hold (for the contrast sliders)
+	nominalHi float64
+	dataMin   float64 // DATAMIN and DATAMAX cards - NaN when absent
+	dataMax   float64
+	signed    bool       // A difference of frames, shown with the diverging stretch of compare.go
+	raw       *frameData // The frame as read, when this is its calibrated copy (see calibration.go) - nil otherwise
+}
+
+// frameFormat holds the header cards that say how the data unit is laid out and how stored values
+// become pixel values
+type frameFormat struct {
+	bitpix       int
+	width        int
+	height       int
+	numPlanes    int    // 3 for an RGB cube, otherwise 1 (only the first plane of other cubes is used)
+	bayerPattern string // BAYERPAT (or COLORTYP) of a raw color frame, e.g. "RGGB" - "" for monochrome
+	bzero        float64
+	bscale       float64
+	blank        float64 // Stored value of an invalid pixel in integer data - NaN when there is no BLANK card
+	dataMin      float64
+	dataMax      float64
+}
+
+func headerFloat(hdr *fitsio.Header, name string, fallback float64) float64 {
+	card := hdr.Get(name)
+	if card == nil {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(fmt.Sprintf("%v", card.Value), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func headerString(hdr *fitsio.Header, name string) string {
+	card := hdr.Get(name)
+	if card == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("%v", card.Value))
+}
+
+func frameFormatFromHDU(hdr *fitsio.Header) frameFormat {
+	format := frameFormat{
+		bitpix:    hdr.Bitpix(),
+		numPlanes: 1,
+		bzero:     headerFloat(hdr, "BZERO", 0.0),
+		bscale:    headerFloat(hdr, "BSCALE", 1.0),
+		blank:     headerFloat(hdr, "BLANK", math.NaN()),
+		dataMin:   headerFloat(hdr, "DATAMIN", math.NaN()),
+		dataMax:   headerFloat(hdr, "DATAMAX", math.NaN()),
+	}
+	axes := hdr.Axes()
+	if len(axes) >= 2 {
+		format.width, format.height = axes[0], axes[1]
+	}
+	if len(axes) >= 3 && axes[2] == 3 {
+		format.numPlanes = 3
+	}
+	format.bayerPattern = bayerPattern(headerString(hdr, "BAYERPAT"), headerString(hdr, "COLORTYP"),
+		int(headerFloat(hdr, "XBAYROFF", 0)), int(headerFloat(hdr, "YBAYROFF", 0)))
+	return format
+}
+
+func frameFormatFromHeader(header *fitsHeader) frameFormat {
+	format := frameFormat{
+		bitpix:    header.intValue("BITPIX", 8),
+		numPlanes: 1,
+		bzero:     header.floatValue("BZERO", 0.0),
+		bscale:    header.floatValue("BSCALE", 1.0),
+		blank:     header.floatValue("BLANK", math.NaN()),
+		dataMin:   header.floatValue("DATAMIN", math.NaN()),
+		dataMax:   header.floatValue("DATAMAX", math.NaN()),
+	}
+	axes := header.axes()
+	if len(axes) >= 2 {
+		format.width, format.height = axes[0], axes[1]
+	}
+	if len(axes) >= 3 && axes[2] == 3 {
+		format.numPlanes = 3
+	}
+	format.bayerPattern = bayerPattern(header.stringValue("BAYERPAT"), header.stringValue("COLORTYP"),
+		header.intValue("XBAYROFF", 0), header.intValue("YBAYROFF", 0))
+	return format
+}
+
+func frameDataFromHDU(hdu fitsio.HDU) *frameData {
+	hdr := hdu.Header()
+	format := frameFormatFromHDU(hdr)
+	if format.width <= 0 || format.height <= 0 {
+		return nil
+	}
+	image, ok := hdu.(fitsio.Image)
+	if !ok {
+		return nil
+	}
+	return decodeFrameData(image.Raw(), format)
+}
+
+func decodePlane(raw []byte, format frameFormat, plane int) []float64 {
+	// raw is the big-endian data unit of the HDU. Returns nil if raw is too short to hold the plane.
+	numPixels := format.width * format.height
+	bytesPerPixel := format.bitpix / 8
+	if bytesPerPixel < 0 {
+		bytesPerPixel = -bytesPerPixel
+	}
+	start := plane * numPixels * bytesPerPixel
+	if len(raw) < start+numPixels*bytesPerPixel {
+		return nil
+	}
+	raw = raw[start:]
+
+	blank := format.blank
+	if format.bitpix < 0 {
+		blank = math.NaN() // BLANK applies to integer data only - invalid float pixels are NaN in the file
+	}
+	pix := make([]float64, numPixels)
+	for i := range numPixels {
+		b := raw[i*bytesPerPixel:]
+		var value float64
+		switch format.bitpix {
+		case 8:
+			value = float64(b[0])
+		case 16:
+			value = float64(int16(binary.BigEndian.Uint16(b)))
+		case 32:
+			value = float64(int32(binary.BigEndian.Uint32(b)))
+		case 64:
+			value = float64(int64(binary.BigEndian.Uint64(b)))
+		case -32:
+			value = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		case -64:
+			value = math.Float64frombits(binary.BigEndian.Uint64(b))
+		}
+		if value == blank || math.IsNaN(value) || math.IsInf(value, 0) {
+			pix[i] = math.NaN()
+			continue
+		}
+		pix[i] = format.bzero + format.bscale*value
+	}
+	return pix
+}
+
+func decodeFrameData(raw []byte, format frameFormat) *frameData {
+	frame := &frameData{width: format.width, height: format.height, bitpix: format.bitpix,
+		dataMin: format.dataMin, dataMax: format.dataMax}
+
+	frame.pix = decodePlane(raw, format, 0)
+	if frame.pix == nil {
+		return nil
+	}
+	if format.numPlanes == 3 {
+		frame.red = frame.pix
+		frame.green = decodePlane(raw, format, 1)
+		frame.blue = decodePlane(raw, format, 2)
+		if frame.green == nil || frame.blue == nil {
+			return nil
+		}
+	} else if format.bayerPattern != "" {
+		frame.red, frame.green, frame.blue = debayer(frame.pix, frame.width, frame.height, format.bayerPattern)
+	}
+	if frame.isColor() {
+		frame.pix = measurementChannel(frame.red, frame.green, frame.blue)
+	}
+
+	// The sliders span what the format can hold for 8 and 16 bit data. Wider integers and
+	// floating point data have no useful nominal range, so DATAMIN/DATAMAX (when present) or the
+	// actual range is used.
+	bzero := format.bzero
+	bscale := format.bscale
+	switch {
+	case format.bitpix == 8:
+		frame.nominalLo, frame.nominalHi = bzero, bzero+bscale*255
+	case format.bitpix == 16:
+		frame.nominalLo, frame.nominalHi = bzero+bscale*math.MinInt16, bzero+bscale*math.MaxInt16
+	case frame.hasDataRange():
+		frame.nominalLo, frame.nominalHi = frame.dataMin, frame.dataMax
+	default:
+		frame.nominalLo, frame.nominalHi = frame.valueRange()
+	}
+	if frame.nominalLo > frame.nominalHi {
+		frame.nominalLo, frame.nominalHi = frame.nominalHi, frame.nominalLo
+	}
+	return frame
+}
+
+func (f *frameData) isColor() bool {
+	return f.red != nil
+}
+
+func (f *frameData) isInvalid(i int) bool {
+	// Pixel i is BLANK or NaN in the measured plane or (in a color frame) in any of the color planes -
+	// debayering leaves the other planes of an invalid site interpolated, and a cube plane can have its own NaNs
+	if math.IsNaN(f.pix[i]) {
+		return true
+	}
+	return f.isColor() && (math.IsNaN(f.red[i]) || math.IsNaN(f.green[i]) || math.IsNaN(f.blue[i]))
+}
+
+func (f *frameData) at(x, y int) float64 {
+	return f.pix[y*f.width+x]
+}
+
+func (f *frameData) valueRange() (lo, hi float64) {
+	lo = math.Inf(1)
+	hi = math.Inf(-1)
+	for _, value := range f.pix {
+		if value < lo {
+			lo = value
+		}
+		if value > hi {
+			hi = value
+		}
+	}
+	if lo > hi { // No pixels
+		return 0, 0
+	}
+	return lo, hi
+}
+
+func (f *frameData) hasDataRange() bool {
+	return !math.IsNaN(f.dataMin) && !math.IsNaN(f.dataMax) && f.dataMax > f.dataMin
+}
+
+func (f *frameData) validSum() float64 {
+	// Sum of the valid pixels
+	sum := 0.0
+	for _, value := range f.pix {
+		if !math.IsNaN(value) {
+			sum += value
+		}
+	}
+	return sum
+}
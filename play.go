@@ -67,6 +67,7 @@ func playForward(loop bool) {
 				myWin.fileIndex = myWin.loopStartIndex - 1
 			}
 		}
+		prefetchAhead(+1, loop)
 		myWin.waitingForFileRead = true
 		// This will increment myWin.fileIndex and invoke getFItsImage() to display the image from that file
 		processForwardOneFrame()
@@ -145,6 +146,7 @@ func playBackward(loop bool) {
 				myWin.fileIndex = myWin.loopStartIndex + 1
 			}
 		}
+		prefetchAhead(-1, loop)
 		myWin.waitingForFileRead = true
 		// This will decrement myWin.fileIndex and invoke getFItsImage() to display the image from that file
 		processBackOneFrame()
@@ -24,16 +24,16 @@ func showROI() {
 	y1 := myWin.y1
 
 	for i := x0; i < x1; i++ {
-		myWin.fitsImages[0].Image.(*image.Gray).Set(i, y0, color.White)
+		myWin.displayImage.Set(i, y0, color.White)
 	}
 	for i := x0; i < x1+1; i++ {
-		myWin.fitsImages[0].Image.(*image.Gray).Set(i, y1, color.White)
+		myWin.displayImage.Set(i, y1, color.White)
 	}
 	for i := y0; i < y1; i++ {
-		myWin.fitsImages[0].Image.(*image.Gray).Set(x0, i, color.White)
+		myWin.displayImage.Set(x0, i, color.White)
 	}
 	for i := y0; i < y1; i++ {
-		myWin.fitsImages[0].Image.(*image.Gray).Set(x1, i, color.White)
+		myWin.displayImage.Set(x1, i, color.White)
 	}
 
 	myWin.centerContent.Refresh()
@@ -126,6 +126,9 @@ func applyRoi(checked bool) {
 	reportROIsettings()
 	validateROIparameters()
 
+	if checked && myWin.drawRoiCheckbox.Checked {
+		myWin.drawRoiCheckbox.SetChecked(false) // The ROI is drawn on the whole frame
+	}
 	myWin.roiActive = checked
 	if checked {
 		myWin.roiChanged = true
@@ -150,6 +153,47 @@ func applyRoi(checked bool) {
 //	}
 //}
 
+func toggleDrawROI(checked bool) {
+	if checked {
+		if myWin.roiActive {
+			myWin.roiCheckbox.SetChecked(false) // This redisplays the whole frame
+		}
+		myWin.imageDragMode = dragModeROI
+	} else if myWin.imageDragMode == dragModeROI {
+		myWin.imageDragMode = dragModeNone
+	}
+	if myWin.imageView != nil {
+		myWin.imageView.placeROIOverlay()
+	}
+}
+
+func idleDragMode() string {
+	// What a drag on the image does when nothing else has asked for one
+	if myWin.drawRoiCheckbox != nil && myWin.drawRoiCheckbox.Checked {
+		return dragModeROI
+	}
+	return dragModeNone
+}
+
+func setROIFromRect(rect image.Rectangle) {
+	// For an ROI drawn on the image - the size and position are saved just as roiEntry() and the jog buttons do
+	myWin.x0, myWin.y0, myWin.x1, myWin.y1 = rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y
+	myWin.roiWidth = rect.Dx()
+	myWin.roiHeight = rect.Dy()
+
+	widthStr := strconv.Itoa(myWin.roiWidth)
+	heightStr := strconv.Itoa(myWin.roiHeight)
+	_ = myWin.widthStr.Set(widthStr)
+	_ = myWin.heightStr.Set(heightStr)
+	myWin.App.Preferences().SetString("ROIwidth", widthStr)
+	myWin.App.Preferences().SetString("ROIheight", heightStr)
+	saveROIposToPreferences()
+	reportROIsettings()
+
+	myWin.roiChanged = true
+	displayFitsImage()
+}
+
 func validateROIparameters() {
 	// Validate ROI size and position - this is needed because the saved values from a previous
 	// run with a different image may have resulted in the saving to preferences of values that
@@ -203,6 +247,7 @@ func enableRoiControls() {
 	myWin.rightButton.Enable()
 	myWin.centerButton.Enable()
 	myWin.drawROIbutton.Enable()
+	myWin.drawRoiCheckbox.Enable()
 }
 
 func disableRoiControls() {
@@ -214,6 +259,7 @@ func disableRoiControls() {
 	myWin.rightButton.Disable()
 	myWin.centerButton.Disable()
 	myWin.drawROIbutton.Disable()
+	myWin.drawRoiCheckbox.Disable()
 }
 
 func roiEntry() {
@@ -300,10 +346,9 @@ func processRoiEntryInfo(ok bool) {
 	}
 }
 
-func validateROIsize(goImage image.Image) {
+func validateROIsize(width, height int) {
 	// Fix user setting ROI X size too large
 	var changeMade = false
-	width := goImage.Bounds().Max.X
 	if myWin.roiWidth > width {
 		changeMade = true
 		myWin.roiWidth = width / 2
@@ -311,7 +356,6 @@ func validateROIsize(goImage image.Image) {
 	}
 
 	// Fix user setting ROI Y size too large
-	height := goImage.Bounds().Max.Y
 	if myWin.roiHeight > height {
 		changeMade = true
 		myWin.roiHeight = height / 2
@@ -335,23 +379,9 @@ func validateROIsize(goImage image.Image) {
 //}
 
 func restoreRect() {
-	myWin.fitsImages[0].Image.(*image.Gray).Rect.Max = image.Point{
-		X: myWin.imageWidth,
-		Y: myWin.imageHeight,
-	}
-	myWin.fitsImages[0].Image.(*image.Gray).Rect.Min = image.Point{
-		X: 0,
-		Y: 0,
-	}
+	myWin.fitsImages[0].Image = myWin.displayImage
 }
 
 func setROIrect() {
-	myWin.fitsImages[0].Image.(*image.Gray).Rect.Max = image.Point{
-		X: myWin.x1,
-		Y: myWin.y1,
-	}
-	myWin.fitsImages[0].Image.(*image.Gray).Rect.Min = image.Point{
-		X: myWin.x0,
-		Y: myWin.y0,
-	}
+	myWin.fitsImages[0].Image = myWin.displayImage.SubImage(image.Rect(myWin.x0, myWin.y0, myWin.x1, myWin.y1))
 }
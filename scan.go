@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// processNewFolder() needs the system timestamps, camera settings and a pixel sum from every frame.
+// None of that needs a decoded image, so the files are read header first, the pixel bytes are summed
+// straight from the data unit, and several files are read at the same time.
+
+type frameScanResult struct {
+	numXpixels   int64
+	numYpixels   int64
+	bitpix       int
+	sysStartTime time.Time
+	sysEndTime   time.Time
+	settings     frameSettings
+	placeholder  bool
+	pixelSum     float64
+	err          error
+}
+
+var errScanCancelled = errors.New("folder scan cancelled")
+
+func parseSysTime(value string) (time.Time, error) {
+	sysTimeString := value + "Z"
+	sysTime, err := time.Parse(time.RFC3339, sysTimeString)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse sysTimeString %s: %w", sysTimeString, err)
+	}
+	return sysTime, nil
+}
+
+func readFrameHeader(path string) (timestamp string, placeholder bool, err error) {
+	// The timestamp loadFrame() would give, and whether the frame is a dropped frame placeholder,
+	// without decoding the pixels (except for a compressed image, whose header comes with them)
+	if cubePath, plane, isPlane := parseCubePlaneRef(path); isPlane {
+		f, err := os.Open(cubePath)
+		if err != nil {
+			return "", false, err
+		}
+		defer f.Close()
+		header, err := readFitsHeader(bufio.NewReaderSize(f, 1<<16))
+		if err != nil {
+			return "", false, err
+		}
+		_, timestamp = formatCubePlaneMetaData(header, cubePath, plane)
+		return timestamp, false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	header, err := readFitsHeader(bufio.NewReaderSize(f, 1<<16))
+	if err != nil {
+		return "", false, err
+	}
+	if len(header.axes()) < 2 {
+		_, header, err = readFirstImage(path)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	_, timestamp = formatHeaderMetaData(header)
+	return timestamp, header.boolValue(droppedFrameCardName), nil
+}
+
+func scanFitsFile(path string) (result frameScanResult) {
+	if cubePath, plane, isPlane := parseCubePlaneRef(path); isPlane {
+		return scanCubePlane(cubePath, plane)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		result.err = fmt.Errorf("could not open file: %w", err)
+		return result
+	}
+	defer f.Close()
+	reader := bufio.NewReaderSize(f, 1<<16)
+
+	header, err := readFitsHeader(reader)
+	if err != nil {
+		result.err = fmt.Errorf("%s: %w", path, err)
+		return result
+	}
+
+	var frame *frameData
+	if len(header.axes()) < 2 {
+		// An empty primary HDU (a .fits.fz file, say) - the image is in an extension (see hdu.go)
+		frame, header, err = readFirstImage(path)
+		if err != nil {
+			result.err = err
+			return result
+		}
+	}
+
+	result.numXpixels = int64(header.intValue("NAXIS1", 0))
+	result.numYpixels = int64(header.intValue("NAXIS2", 0))
+	result.bitpix = header.intValue("BITPIX", 8)
+	result.settings = readFrameSettings(header)
+	result.placeholder = header.boolValue(droppedFrameCardName)
+
+	// Our objective here is to get the card that contains the original SharpCap system frame start time. In an
+	// unprocessed folder, that will be a DATE-OBS card.
+	// For a folder that has aleady had GPS timestamps added, the original SharpCap DATE-OBS card
+	// has been renamed and preserved as an OBS-DATE card
+	sysTimeCard, ok := header.get("OBS-DATE")
+	if !ok { // This is an unprocessed folder. The frame start time is in a DATE-OBS card.
+		sysTimeCard, ok = header.get("DATE-OBS")
+		if !ok {
+			// An original SharpCap capture always has a DATE-OBS card. We depend on this.
+			result.err = fmt.Errorf("could not find a DATE-OBS card in %s. This is required", path)
+			return result
+		}
+	}
+	if !header.has("EXPTIME") {
+		// A SharpCap capture always has an EXPTIME card. We depend on this.
+		result.err = fmt.Errorf("could not find an EXPTIME card in %s. This is required", path)
+		return result
+	}
+	dateEndCard, ok := header.get("DATE-END")
+	if !ok {
+		// A SharpCap capture always has a DATE-END card. We depend on this.
+		result.err = fmt.Errorf("could not find a DATE-END card in %s. This is required", path)
+		return result
+	}
+
+	result.sysStartTime, result.err = parseSysTime(sysTimeCard.value)
+	if result.err != nil {
+		return result
+	}
+	result.sysEndTime, result.err = parseSysTime(dateEndCard.value)
+	if result.err != nil || result.placeholder {
+		return result // A placeholder has no measurement, so there is no need to read its pixels
+	}
+
+	// Same value that pixelSum() computes from the decoded frame: the sum of the valid pixels
+	if frame == nil {
+		raw := make([]byte, header.dataBytes())
+		_, err = io.ReadFull(reader, raw)
+		if err != nil {
+			result.err = fmt.Errorf("%s: data unit is truncated: %w", path, err)
+			return result
+		}
+		frame = decodeFrameData(raw, frameFormatFromHeader(header))
+	}
+	if frame != nil {
+		result.pixelSum = calibrateFrame(frame).validSum()
+	}
+	return result
+}
+
+func scanCubePlane(path string, plane int) (result frameScanResult) {
+	// The same as scanFitsFile() for one frame of a cube. The times come from the cube's table.
+	header, frame, err := readCubePlane(path, plane)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.numXpixels = int64(frame.width)
+	result.numYpixels = int64(frame.height)
+	result.bitpix = frame.bitpix
+	result.settings = readFrameSettings(header)
+	result.pixelSum = calibrateFrame(frame).validSum()
+
+	var ok bool
+	result.sysStartTime, result.sysEndTime, ok = cubePlaneTimes(path, plane)
+	if !ok {
+		result.err = fmt.Errorf("%s has no frame time for plane %d. A table of frame times is required", path, plane+1)
+	}
+	return result
+}
+
+func scanFitsFolder(paths []string, numDone *atomic.Int64, cancel <-chan struct{}) ([]frameScanResult, error) {
+	// Returns one result per path, in the same order as paths. numDone counts finished files.
+	results := make([]frameScanResult, len(paths))
+	work := make(chan int)
+	var wg sync.WaitGroup
+
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				results[k] = scanFitsFile(paths[k])
+				numDone.Add(1)
+			}
+		}()
+	}
+
+	cancelled := false
+feedWorkers:
+	for k := range paths {
+		select {
+		case work <- k:
+		case <-cancel:
+			cancelled = true
+			break feedWorkers
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if cancelled {
+		return nil, errScanCancelled
+	}
+	return results, nil
+}
+
+func scanFitsFolderWithProgress(paths []string) ([]frameScanResult, error) {
+	// The progress display is a window of its own (rather than a dialog on the main window) so that
+	// its Cancel button works even when we are called from a main window event handler.
+	progressWin := myWin.App.NewWindow("Reading FITS folder")
+	progressWin.Resize(fyne.Size{Height: 120, Width: 500})
+
+	progressBar := widget.NewProgressBar()
+	progressBar.Max = float64(len(paths))
+	etaLabel := widget.NewLabel("")
+	cancel := make(chan struct{})
+	var cancelOnce sync.Once
+	cancelScan := func() { cancelOnce.Do(func() { close(cancel) }) }
+	cancelButton := widget.NewButton("Cancel", cancelScan)
+
+	progressWin.SetContent(container.NewVBox(progressBar, etaLabel, container.NewCenter(cancelButton)))
+	progressWin.SetCloseIntercept(cancelScan)
+	progressWin.CenterOnScreen()
+	progressWin.Show()
+
+	var numDone atomic.Int64
+	startTime := time.Now()
+	done := make(chan struct{})
+	go func() { // Update the display at a sensible rate rather than once per file
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				count := int(numDone.Load())
+				progressBar.SetValue(float64(count))
+				if count > 0 {
+					elapsed := time.Since(startTime)
+					eta := time.Duration(float64(elapsed) / float64(count) * float64(len(paths)-count))
+					etaLabel.SetText(fmt.Sprintf("%d of %d files    time remaining: %s",
+						count, len(paths), eta.Round(time.Second)))
+				}
+			}
+		}
+	}()
+
+	results, err := scanFitsFolder(paths, &numDone, cancel)
+
+	close(done)
+	progressWin.Close()
+	log.Printf("folder scan of %d files took %s\n", len(paths), time.Since(startTime).Round(time.Millisecond))
+	return results, err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The dead time and timestamp uncertainty calculations assume a single exposure time for the whole
+// recording. processNewFolder() records the camera settings of every frame so that a recording in which
+// EXPTIME, GAIN or binning changed part way through can be reported (and not timestamped).
+
+type frameSettings struct {
+	expTime  float64
+	gain     string // Optional cards are kept as text ("" when absent) so that comparisons are exact
+	xBinning string
+	yBinning string
+}
+
+type settingsSegment struct {
+	firstFrame int // Indices into the frame list as read from the folder (before dropped frame insertion)
+	lastFrame  int
+	settings   frameSettings
+}
+
+func readFrameSettings(header *fitsHeader) frameSettings {
+	var settings frameSettings
+	settings.expTime = header.floatValue("EXPTIME", 0.0)
+	settings.gain = header.stringValue("GAIN")
+	settings.xBinning = header.stringValue("XBINNING")
+	settings.yBinning = header.stringValue("YBINNING")
+	return settings
+}
+
+func addFrameSettings(frameIndex int, settings frameSettings) {
+	n := len(myWin.settingsSegments)
+	if n > 0 && myWin.settingsSegments[n-1].settings == settings {
+		myWin.settingsSegments[n-1].lastFrame = frameIndex
+		return
+	}
+	myWin.settingsSegments = append(myWin.settingsSegments,
+		settingsSegment{firstFrame: frameIndex, lastFrame: frameIndex, settings: settings})
+}
+
+func cameraSettingsChanged() bool {
+	return len(myWin.settingsSegments) > 1
+}
+
+func (s frameSettings) String() string {
+	text := fmt.Sprintf("EXPTIME %0.6f", s.expTime)
+	if s.gain != "" {
+		text += "  GAIN " + s.gain
+	}
+	if s.xBinning != "" || s.yBinning != "" {
+		text += fmt.Sprintf("  binning %sx%s", s.xBinning, s.yBinning)
+	}
+	return text
+}
+
+func settingsChangeReport() string {
+	report := "Camera settings changed during the recording:\n\n"
+	for _, segment := range myWin.settingsSegments {
+		report += fmt.Sprintf("frames %d to %d (%s ... %s)\n    %s\n",
+			segment.firstFrame, segment.lastFrame,
+			filepath.Base(myWin.scannedFitsFilePaths[segment.firstFrame]),
+			filepath.Base(myWin.scannedFitsFilePaths[segment.lastFrame]),
+			segment.settings)
+	}
+	report += "\nTimestamp insertion needs a single exposure time for the whole recording,\n" +
+		"so it will not be done for this folder."
+	return report
+}
+
+func checkExposureTimesUnchanged() error {
+	// Reads the header of every frame again just before timestamp insertion, which opens each file for
+	// writing in turn - so a folder that changed since it was scanned is found before any file is touched
+	for _, frameFile := range myWin.fitsFilePaths {
+		if frameFile == droppedFrameString {
+			continue
+		}
+		f, err := os.Open(frameFile)
+		if err != nil {
+			return fmt.Errorf("could not open %s: %w", frameFile, err)
+		}
+		header, err := readFitsHeader(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", frameFile, err)
+		}
+		if !header.has("EXPTIME") {
+			// A SharpCap capture always has an EXPTIME card. We depend on this.
+			return fmt.Errorf("could not find an EXPTIME card in\n%s\nThis is required", frameFile)
+		}
+		if expTime := header.floatValue("EXPTIME", 0.0); expTime != myWin.expTimeSeconds {
+			return fmt.Errorf("the EXPTIME of %0.6f in\n%s\ndiffers from the %0.6f found when the folder was scanned",
+				expTime, frameFile, myWin.expTimeSeconds)
+		}
+	}
+	return nil
+}
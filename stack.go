@@ -0,0 +1,399 @@
+package main
+
+import (
+	"FITSreader/fitsio"
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Display modes that combine frames, and the stacking of the loop range into one deep image.
+// The running mean/median is over myWin.runningFrames frames centered on the playhead (taken from
+// the frame cache). Only the display changes - the lightcurve still measures the single frame.
+
+const displaySingle = "single frame"
+const displayRunningMean = "running mean"
+const displayRunningMedian = "running median"
+
+var displayModes = []string{displaySingle, displayRunningMean, displayRunningMedian,
+	displayDiffReference, displayDiffPrevious} // The difference modes are in compare.go
+
+const maxRunningFrames = 99
+
+type stackedImage struct {
+	frame          *frameData
+	numFrames      int
+	firstIndex     int
+	lastIndex      int
+	firstPath      string
+	lastPath       string
+	firstTimestamp string
+	lastTimestamp  string
+}
+
+func loadDisplayModeSettings() {
+	prefs := myWin.App.Preferences()
+	myWin.displayMode = prefs.StringWithFallback("DisplayMode", displaySingle)
+	myWin.runningFrames = prefs.IntWithFallback("RunningFrames", 5)
+}
+
+func selectDisplayMode(mode string) {
+	myWin.displayMode = mode
+	myWin.App.Preferences().SetString("DisplayMode", myWin.displayMode)
+	if len(myWin.fitsImages) > 0 {
+		displayFitsImage()
+	}
+}
+
+func setRunningFrames(text string) {
+	// Called as the entry is typed in - anything that is not a usable count is ignored
+	n, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || n < 1 || n > maxRunningFrames || n == myWin.runningFrames {
+		return
+	}
+	myWin.runningFrames = n
+	myWin.App.Preferences().SetInt("RunningFrames", myWin.runningFrames)
+	if myWin.displayMode != displaySingle && len(myWin.fitsImages) > 0 {
+		displayFitsImage()
+	}
+}
+
+func displayedFrame(frame *frameData) *frameData {
+	// What is shown for frame (the frame at myWin.fileIndex) in the current display mode
+	switch myWin.displayMode {
+	case displayRunningMean, displayRunningMedian:
+		return runningFrame(frame)
+	case displayDiffReference, displayDiffPrevious:
+		return differenceFrame(frame)
+	}
+	return frame
+}
+
+func runningFrame(center *frameData) *frameData {
+	n := max(1, myWin.runningFrames)
+	first := myWin.fileIndex - n/2
+	var frames []*frameData
+	for k := first; k < first+n; k++ {
+		if k < 0 || k >= len(myWin.fitsFilePaths) || myWin.fitsFilePaths[k] == droppedFrameString {
+			continue
+		}
+		if k == myWin.fileIndex {
+			frames = append(frames, center)
+			continue
+		}
+		entry, _, err := myWin.frameCache.get(myWin.fitsFilePaths[k])
+		if err != nil || !sameLayout(entry.frame, center) {
+			continue
+		}
+		frames = append(frames, entry.frame)
+	}
+
+	if myWin.displayMode == displayRunningMedian {
+		return medianFrame(frames)
+	}
+	var stack frameStack
+	for _, frame := range frames {
+		stack.add(frame)
+	}
+	return stack.result(false)
+}
+
+func sameLayout(a, b *frameData) bool {
+	return a.width == b.width && a.height == b.height && a.isColor() == b.isColor()
+}
+
+func framePlanes(frame *frameData) [4][]float64 {
+	return [4][]float64{frame.pix, frame.red, frame.green, frame.blue}
+}
+
+func medianFrame(frames []*frameData) *frameData {
+	median := *frames[0]
+	allPlanes := make([][4][]float64, len(frames))
+	for k, frame := range frames {
+		allPlanes[k] = framePlanes(frame)
+	}
+	var planes [4][]float64
+	values := make([]float64, 0, len(frames))
+	for p, plane := range allPlanes[0] {
+		if plane == nil {
+			continue
+		}
+		out := make([]float64, len(plane))
+		for i := range out {
+			values = values[:0]
+			for _, planesOfFrame := range allPlanes {
+				if value := planesOfFrame[p][i]; !math.IsNaN(value) {
+					values = append(values, value)
+				}
+			}
+			out[i] = medianOf(values)
+		}
+		planes[p] = out
+	}
+	median.pix, median.red, median.green, median.blue = planes[0], planes[1], planes[2], planes[3]
+	return &median
+}
+
+func medianOf(values []float64) float64 {
+	// median() without the sort, for the few values of a running median (insertion sort in place)
+	for i := 1; i < len(values); i++ {
+		for j := i; j > 0 && values[j] < values[j-1]; j-- {
+			values[j], values[j-1] = values[j-1], values[j]
+		}
+	}
+	n := len(values)
+	switch {
+	case n == 0:
+		return math.NaN()
+	case n%2 == 1:
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// frameStack accumulates frames one at a time, so a long loop range never has to be held in memory
+type frameStack struct {
+	template  *frameData
+	numFrames int
+	sums      [4][]float64 // pix, red, green, blue
+	counts    [4][]int32   // Frames in which the pixel was valid
+}
+
+func (s *frameStack) add(frame *frameData) bool {
+	// Returns false (and ignores frame) when frame is not the size and type of the first one added
+	if s.template == nil {
+		s.template = frame
+		for p, plane := range framePlanes(frame) {
+			if plane != nil {
+				s.sums[p] = make([]float64, len(plane))
+				s.counts[p] = make([]int32, len(plane))
+			}
+		}
+	} else if !sameLayout(frame, s.template) {
+		return false
+	}
+	for p, plane := range framePlanes(frame) {
+		if plane == nil {
+			continue
+		}
+		for i, value := range plane {
+			if !math.IsNaN(value) {
+				s.sums[p][i] += value
+				s.counts[p][i] += 1
+			}
+		}
+	}
+	s.numFrames += 1
+	return true
+}
+
+func (s *frameStack) result(sum bool) *frameData {
+	// The mean of the frames added or (sum true) their sum. A pixel that is invalid in some of the
+	// frames is scaled up from the frames where it is valid. Invalid in all of them, it stays invalid.
+	frame := *s.template
+	var planes [4][]float64
+	for p := range s.sums {
+		if s.sums[p] == nil {
+			continue
+		}
+		out := make([]float64, len(s.sums[p]))
+		for i := range out {
+			if s.counts[p][i] == 0 {
+				out[i] = math.NaN()
+				continue
+			}
+			out[i] = s.sums[p][i] / float64(s.counts[p][i])
+			if sum {
+				out[i] *= float64(s.numFrames)
+			}
+		}
+		planes[p] = out
+	}
+	frame.pix, frame.red, frame.green, frame.blue = planes[0], planes[1], planes[2], planes[3]
+	if sum {
+		frame.nominalLo *= float64(s.numFrames)
+		frame.nominalHi *= float64(s.numFrames)
+		frame.dataMin = math.NaN()
+		frame.dataMax = math.NaN()
+	}
+	return &frame
+}
+
+func stackLoopRange() {
+	if myWin.loopStartIndex < 0 || myWin.loopEndIndex < 0 {
+		dialog.ShowInformation("Oops", "You need to Set loop start and Set loop end", myWin.parentWindow)
+		return
+	}
+	if len(myWin.fitsImages) == 0 {
+		return
+	}
+	first := min(myWin.loopStartIndex, myWin.loopEndIndex)
+	last := min(max(myWin.loopStartIndex, myWin.loopEndIndex), len(myWin.fitsFilePaths)-1)
+
+	busy := dialog.NewCustomWithoutButtons(fmt.Sprintf("Stacking frames %d to %d", first, last),
+		widget.NewProgressBarInfinite(), myWin.parentWindow)
+	busy.Show()
+	go func() {
+		// The frames are read directly rather than through the cache so that the cache keeps what is being played
+		stacked := &stackedImage{firstIndex: first, lastIndex: last}
+		var stack frameStack
+		for k := first; k <= last; k++ {
+			path := myWin.fitsFilePaths[k]
+			if path == droppedFrameString {
+				continue
+			}
+			frame, _, timestamp, err := loadFrame(path)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if !stack.add(frame) {
+				log.Printf("%s is not the size and type of %s - it was not stacked\n", path, stacked.firstPath)
+				continue
+			}
+			if stacked.firstPath == "" {
+				stacked.firstPath = path
+				stacked.firstTimestamp = timestamp
+			}
+			stacked.lastPath = path
+			stacked.lastTimestamp = timestamp
+		}
+		busy.Hide()
+		if stack.numFrames == 0 {
+			dialog.ShowInformation("Oops", "There are no frames to stack in the loop range", myWin.parentWindow)
+			return
+		}
+		stacked.frame = stack.result(true)
+		stacked.numFrames = stack.numFrames
+		myWin.stacked = stacked
+		log.Printf("stacked %d frames (%d to %d)  %s\n", stacked.numFrames, first, last, calibrationDescription())
+
+		// The sum has its own range, so the sliders are set up for it (and back for the frames by displayFitsImage)
+		myWin.stackShown = true
+		setContrastSliderRange(stacked.frame)
+		myWin.adjustSliders = true
+		myWin.fileLabel.SetText(fmt.Sprintf("Sum of %d frames (%d to %d)", stacked.numFrames, first, last))
+		myWin.timestampLabel.Text = stacked.firstTimestamp
+		showFrame(stacked.frame)
+
+		dialog.ShowConfirm("Stacked image",
+			fmt.Sprintf("%d frames were summed.\n\nSave the stacked image as a FITS file?", stacked.numFrames),
+			func(ok bool) {
+				if ok {
+					saveStackedImage(stacked)
+				}
+			}, myWin.parentWindow)
+	}()
+}
+
+func saveStackedImage(stacked *stackedImage) {
+	fileSave := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+		if err != nil || writer == nil {
+			return
+		}
+		path := writer.URI().Path()
+		_ = writer.Close()
+		err = writeStackedFitsFile(path, stacked)
+		if err != nil {
+			dialog.ShowInformation("Stacked image", err.Error(), myWin.parentWindow)
+			return
+		}
+		log.Printf("stacked image written to %s\n", path)
+	}, myWin.parentWindow)
+	fileSave.SetFileName(fmt.Sprintf("stack_%d_%d.fits", stacked.firstIndex, stacked.lastIndex))
+	showFileSave(fileSave)
+}
+
+func showFileSave(fileSave *dialog.FileDialog) {
+	// Save dialogs start in the FITS folder
+	if myWin.folderSelected != "" {
+		if folder, err := storage.ListerForURI(storage.NewFileURI(myWin.folderSelected)); err == nil {
+			fileSave.SetLocation(folder)
+		}
+	}
+	fileSave.Resize(fyne.Size{Width: 800, Height: 600})
+	fileSave.Show()
+}
+
+func fitsTimestamp(timestamp string) (string, bool) {
+	// Our display timestamps have a space where FITS has a T. false for "<no timestamp found>".
+	if timestamp == "" || strings.HasPrefix(timestamp, "<") {
+		return "", false
+	}
+	return strings.Replace(timestamp, " ", "T", 1), true
+}
+
+func writeStackedFitsFile(path string, stacked *stackedImage) error {
+	// 32 bit float pixels (a sum overflows the integer types of the frames). A color stack is an
+	// RGB cube (NAXIS3 = 3). The cards say where the image came from.
+	frame := stacked.frame
+	numPixels := frame.width * frame.height
+	axes := []int{frame.width, frame.height}
+	planes := [][]float64{frame.pix}
+	if frame.isColor() {
+		axes = append(axes, 3)
+		planes = [][]float64{frame.red, frame.green, frame.blue}
+	}
+	data := make([]float32, 0, numPixels*len(planes))
+	for _, plane := range planes {
+		for _, value := range plane {
+			data = append(data, float32(value))
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", path, err)
+	}
+	defer f.Close()
+
+	outFile, err := fitsio.Create(f)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	img := fitsio.NewImage(-32, axes)
+	defer img.Close()
+
+	cards := []fitsio.Card{
+		{Name: "NCOMBINE", Value: stacked.numFrames, Comment: "number of frames summed"},
+		{Name: "STACKMTH", Value: "sum", Comment: "how the frames were combined"},
+		{Name: "STACKFST", Value: filepath.Base(stacked.firstPath), Comment: "first frame stacked"},
+		{Name: "STACKLST", Value: filepath.Base(stacked.lastPath), Comment: "last frame stacked"},
+	}
+	if timestamp, ok := fitsTimestamp(stacked.firstTimestamp); ok {
+		cards = append(cards, fitsio.Card{Name: "DATE-OBS", Value: timestamp, Comment: "start of the first frame stacked"})
+	}
+	if timestamp, ok := fitsTimestamp(stacked.lastTimestamp); ok {
+		cards = append(cards, fitsio.Card{Name: "DATE-LST", Value: timestamp, Comment: "start of the last frame stacked"})
+	}
+	if myWin.expTimeSeconds > 0 {
+		cards = append(cards, fitsio.Card{Name: "EXPTIME", Value: myWin.expTimeSeconds * float64(stacked.numFrames),
+			Comment: "total exposure time (seconds)"})
+	}
+	cards = append(cards,
+		fitsio.Card{Name: "HISTORY", Comment: fmt.Sprintf("Sum of frames %d to %d of %s",
+			stacked.firstIndex, stacked.lastIndex, myWin.folderSelected)},
+		fitsio.Card{Name: "HISTORY", Comment: calibrationDescription()},
+		fitsio.Card{Name: "HISTORY", Comment: "Stacked by " + processedByIotaUtilities},
+	)
+	err = img.Header().Append(cards...)
+	if err != nil {
+		return err
+	}
+
+	err = img.Write(data)
+	if err != nil {
+		return err
+	}
+	return outFile.Write(img)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/montanaflynn/stats"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Stretch functions used by applyContrastControls(). Except for zscale (which picks its own black and white
+// levels) the black/white sliders set the range of ADU values that is stretched, and the stretch
+// function maps that range onto 0..255. The curve is tabulated so that the per-pixel cost does not
+// depend on which stretch is selected.
+
+var stretchNames = []string{"linear", "sqrt", "log", "asinh", "histeq", "zscale"}
+
+const stretchCurveSize = 4096
+
+func loadStretchSettings() {
+	prefs := myWin.App.Preferences()
+	myWin.stretchName = prefs.StringWithFallback("StretchName", "linear")
+	myWin.sqrtPower = prefs.FloatWithFallback("StretchSqrtPower", 0.5)
+	myWin.logScale = prefs.FloatWithFallback("StretchLogScale", 1000)
+	myWin.asinhSoftening = prefs.FloatWithFallback("StretchAsinhSoftening", 0.1)
+	myWin.histEqStrength = prefs.FloatWithFallback("StretchHistEqStrength", 1.0)
+	myWin.zscaleContrast = prefs.FloatWithFallback("StretchZscaleContrast", 0.25)
+	myWin.zscaleSamples = prefs.IntWithFallback("StretchZscaleSamples", 1000)
+}
+
+func saveStretchSettings() {
+	prefs := myWin.App.Preferences()
+	prefs.SetString("StretchName", myWin.stretchName)
+	prefs.SetFloat("StretchSqrtPower", myWin.sqrtPower)
+	prefs.SetFloat("StretchLogScale", myWin.logScale)
+	prefs.SetFloat("StretchAsinhSoftening", myWin.asinhSoftening)
+	prefs.SetFloat("StretchHistEqStrength", myWin.histEqStrength)
+	prefs.SetFloat("StretchZscaleContrast", myWin.zscaleContrast)
+	prefs.SetInt("StretchZscaleSamples", myWin.zscaleSamples)
+}
+
+func selectStretch(name string) {
+	myWin.stretchName = name
+	saveStretchSettings()
+	if len(myWin.fitsImages) > 0 {
+		displayFitsImage()
+	}
+}
+
+func stretchSettingsEntry() {
+	sqrtEntry := widget.NewEntry()
+	sqrtEntry.SetText(fmt.Sprintf("%g", myWin.sqrtPower))
+	logEntry := widget.NewEntry()
+	logEntry.SetText(fmt.Sprintf("%g", myWin.logScale))
+	asinhEntry := widget.NewEntry()
+	asinhEntry.SetText(fmt.Sprintf("%g", myWin.asinhSoftening))
+	histEqEntry := widget.NewEntry()
+	histEqEntry.SetText(fmt.Sprintf("%g", myWin.histEqStrength))
+	contrastEntry := widget.NewEntry()
+	contrastEntry.SetText(fmt.Sprintf("%g", myWin.zscaleContrast))
+	samplesEntry := widget.NewEntry()
+	samplesEntry.SetText(strconv.Itoa(myWin.zscaleSamples))
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("sqrt: power (0 to 1)", sqrtEntry),
+		widget.NewFormItem("log: scale (> 0)", logEntry),
+		widget.NewFormItem("asinh: softening (> 0)", asinhEntry),
+		widget.NewFormItem("histeq: strength (0 to 1)", histEqEntry),
+		widget.NewFormItem("zscale: contrast (> 0)", contrastEntry),
+		widget.NewFormItem("zscale: samples (>= 100)", samplesEntry),
+	}
+	dialog.ShowForm("Stretch settings", "OK", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		sqrtPower, err0 := strconv.ParseFloat(sqrtEntry.Text, 64)
+		logScale, err1 := strconv.ParseFloat(logEntry.Text, 64)
+		asinhSoftening, err2 := strconv.ParseFloat(asinhEntry.Text, 64)
+		histEqStrength, err3 := strconv.ParseFloat(histEqEntry.Text, 64)
+		zscaleContrast, err4 := strconv.ParseFloat(contrastEntry.Text, 64)
+		zscaleSamples, err5 := strconv.Atoi(samplesEntry.Text)
+		if err0 != nil || err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil {
+			dialog.ShowInformation("Oops", "A number is needed in every field.", myWin.parentWindow)
+			return
+		}
+		if sqrtPower <= 0 || sqrtPower > 1 || logScale <= 0 || asinhSoftening <= 0 ||
+			histEqStrength < 0 || histEqStrength > 1 || zscaleContrast <= 0 || zscaleSamples < 100 {
+			dialog.ShowInformation("Oops", "A value is outside its allowed range.", myWin.parentWindow)
+			return
+		}
+		myWin.sqrtPower = sqrtPower
+		myWin.logScale = logScale
+		myWin.asinhSoftening = asinhSoftening
+		myWin.histEqStrength = histEqStrength
+		myWin.zscaleContrast = zscaleContrast
+		myWin.zscaleSamples = zscaleSamples
+		saveStretchSettings()
+		if len(myWin.fitsImages) > 0 {
+			displayFitsImage()
+		}
+	}, myWin.parentWindow)
+}
+
+func statsRegionPixels(original []float64) []float64 {
+	// The pixels that histeq and zscale take their statistics from: the ROI when one is applied
+	// (so that the ROI view is stretched for what is in it), otherwise the whole frame.
+	if !myWin.roiActive {
+		return original
+	}
+	var pixels []float64
+	for y := max(myWin.y0, 0); y < min(myWin.y1, myWin.imageHeight); y++ {
+		for x := max(myWin.x0, 0); x < min(myWin.x1, myWin.imageWidth); x++ {
+			pixels = append(pixels, original[y*myWin.imageWidth+x])
+		}
+	}
+	return pixels
+}
+
+func stretchCurve(statsPixels []float64, bot, top float64) []byte {
+	// Returns the 8 bit display value for (stretchCurveSize+1) evenly spaced ADU values from bot to top,
+	// or nil for a linear stretch.
+	f := stretchFunction(statsPixels, bot, top)
+	if f == nil {
+		return nil
+	}
+	curve := make([]byte, stretchCurveSize+1)
+	for i := range curve {
+		curve[i] = byte(math.Round(255 * f(float64(i)/stretchCurveSize)))
+	}
+	return curve
+}
+
+func stretchFunction(statsPixels []float64, bot, top float64) func(t float64) float64 {
+	// Maps t (0 at bot, 1 at top) onto 0..1 - nil for a linear stretch
+	var f func(t float64) float64
+	switch myWin.stretchName {
+	case "sqrt":
+		f = func(t float64) float64 { return math.Pow(t, myWin.sqrtPower) }
+	case "log":
+		f = func(t float64) float64 { return math.Log(myWin.logScale*t+1) / math.Log(myWin.logScale+1) }
+	case "asinh":
+		f = func(t float64) float64 {
+			return math.Asinh(t/myWin.asinhSoftening) / math.Asinh(1/myWin.asinhSoftening)
+		}
+	case "histeq":
+		f = histEqFunction(statsPixels, bot, top)
+	}
+	return f
+}
+
+func histEqFunction(statsPixels []float64, bot, top float64) func(t float64) float64 {
+	// The cumulative distribution of the pixels between bot and top, blended with a linear ramp
+	// according to myWin.histEqStrength
+	counts := make([]float64, stretchCurveSize+1)
+	total := 0.0
+	for _, value := range statsPixels {
+		if value > bot && value <= top {
+			counts[int((value-bot)/(top-bot)*stretchCurveSize)] += 1
+			total += 1
+		}
+	}
+	if total == 0 {
+		return func(t float64) float64 { return t }
+	}
+	cdf := make([]float64, len(counts))
+	sum := 0.0
+	for i, count := range counts {
+		sum += count
+		cdf[i] = sum / total
+	}
+	strength := myWin.histEqStrength
+	return func(t float64) float64 {
+		return strength*cdf[int(t*stretchCurveSize)] + (1-strength)*t
+	}
+}
+
+func zscale(pixels []float64, contrast float64, numSamples int) (z1, z2 float64) {
+	// The IRAF zscale algorithm: fit a line to the sorted values of a regular sample of the pixels
+	// (rejecting outliers), then take the range the line covers, with its slope divided by contrast,
+	// centered on the median.
+	const maxReject = 0.5
+	const minNumPixels = 5
+	const rejectSigma = 2.5
+	const maxIterations = 5
+
+	stride := max(len(pixels)/numSamples, 1)
+	var samples []float64
+	for i := 0; i < len(pixels); i += stride {
+		if !math.IsNaN(pixels[i]) {
+			samples = append(samples, pixels[i])
+		}
+	}
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	sort.Float64s(samples)
+	numPix := len(samples)
+	zMin := samples[0]
+	zMax := samples[numPix-1]
+	centerPixel := (numPix - 1) / 2
+	median := samples[centerPixel]
+	if numPix%2 == 0 {
+		median = (samples[centerPixel] + samples[centerPixel+1]) / 2
+	}
+
+	minPix := max(minNumPixels, int(float64(numPix)*maxReject))
+	numGrow := max(1, numPix/100)
+	bad := make([]bool, numPix)
+	numGood := numPix
+	lastNumGood := numPix + 1
+	slope := 0.0
+	for range maxIterations {
+		if numGood >= lastNumGood || numGood < minPix {
+			break
+		}
+
+		// Least squares line through the good samples
+		var sumX, sumY, sumXX, sumXY, n float64
+		for i, value := range samples {
+			if !bad[i] {
+				x := float64(i)
+				sumX += x
+				sumY += value
+				sumXX += x * x
+				sumXY += x * value
+				n += 1
+			}
+		}
+		denominator := n*sumXX - sumX*sumX
+		if denominator == 0 {
+			break
+		}
+		slope = (n*sumXY - sumX*sumY) / denominator
+		intercept := (sumY - slope*sumX) / n
+
+		// Reject samples far from the line, along with their neighbours
+		var residuals []float64
+		for i, value := range samples {
+			if !bad[i] {
+				residuals = append(residuals, value-(intercept+slope*float64(i)))
+			}
+		}
+		residualStd, _ := stats.StandardDeviation(residuals)
+		threshold := rejectSigma * residualStd
+		newBad := make([]bool, numPix)
+		for i, value := range samples {
+			residual := value - (intercept + slope*float64(i))
+			if bad[i] || residual < -threshold || residual > threshold {
+				for j := max(i-numGrow/2, 0); j <= min(i+numGrow/2, numPix-1); j++ {
+					newBad[j] = true
+				}
+			}
+		}
+		bad = newBad
+		lastNumGood = numGood
+		numGood = 0
+		for _, isBad := range bad {
+			if !isBad {
+				numGood += 1
+			}
+		}
+	}
+
+	if numGood < minPix {
+		return zMin, zMax
+	}
+	slope /= contrast
+	z1 = math.Max(zMin, median-float64(centerPixel-1)*slope)
+	z2 = math.Min(zMax, median+float64(numPix-centerPixel)*slope)
+	return z1, z2
+}
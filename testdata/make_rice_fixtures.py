@@ -0,0 +1,121 @@
+# Writes RICE_1 tile compressed FITS files laid out as fpack writes them. The compression is a port of
+# fits_rcomp()/fits_rcomp_short() and the quantization of fits_quantize_float() from cfitsio.
+# Run it in this folder (python3 make_rice_fixtures.py) to write rice16.fits.fz and riceq32.fits.fz.
+import struct, math
+
+def randoms():
+    a, m, seed = 16807.0, 2147483647.0, 1.0
+    out = []
+    for i in range(10000):
+        temp = a * seed
+        seed = temp - m * float(int(temp / m))
+        out.append(struct.unpack('f', struct.pack('f', seed / m))[0])
+    assert int(seed) == 1043618065  # the check in fits_init_randoms()
+    return out
+
+RAND = randoms()
+
+class Bits:
+    def __init__(self): self.bits = []
+    def put(self, value, n):
+        for k in range(n - 1, -1, -1): self.bits.append((value >> k) & 1)
+    def bytes(self):
+        b = self.bits + [0] * (-len(self.bits) % 8)
+        return bytes(int(''.join(map(str, b[i:i + 8])), 2) for i in range(0, len(b), 8))
+
+def rcomp(a, bytepix, nblock=32):
+    fsbits, fsmax, bbits = {2: (4, 14, 16), 4: (5, 25, 32)}[bytepix]
+    mask = (1 << bbits) - 1
+    out = Bits()
+    out.put(a[0] & mask, bbits)
+    lastpix = a[0]
+    for i in range(0, len(a), nblock):
+        block = a[i:i + nblock]
+        diffs = []
+        for nextpix in block:
+            pdiff = nextpix - lastpix
+            d = (~(pdiff << 1)) if pdiff < 0 else (pdiff << 1)
+            diffs.append(d & 0xffffffff)
+            lastpix = nextpix
+        pixelsum = sum(diffs)
+        dpsum = (pixelsum - (len(block) // 2) - 1) / len(block)
+        psum = int(max(dpsum, 0)) >> 1
+        fs = 0
+        while psum > 0:
+            psum >>= 1; fs += 1
+        if fs >= fsmax:
+            out.put(fsmax + 1, fsbits)
+            for d in diffs: out.put(d & mask, bbits)
+        elif fs == 0 and pixelsum == 0:
+            out.put(0, fsbits)
+        else:
+            out.put(fs + 1, fsbits)
+            for d in diffs:
+                out.put(1, (d >> fs) + 1)
+                if fs > 0: out.put(d & ((1 << fs) - 1), fs)
+    return out.bytes()
+
+def card(name, value, comment=''):
+    if isinstance(value, bool): v = ('T' if value else 'F').rjust(20)
+    elif isinstance(value, str): v = ("'" + value.ljust(8) + "'").ljust(20)
+    elif isinstance(value, float): v = repr(value).rjust(20)
+    else: v = str(value).rjust(20)
+    text = name.ljust(8) + '= ' + v
+    if comment: text += ' / ' + comment
+    return text.ljust(80)[:80]
+
+def header(cards):
+    text = ''.join(cards) + 'END'.ljust(80)
+    return (text + ' ' * (-len(text) % 2880)).encode('ascii')
+
+def pad(data): return data + b'\0' * (-len(data) % 2880)
+
+def write(path, width, height, zbitpix, tiles, extra, scales=None):
+    # tiles: compressed bytes per tile (one tile per image row)
+    primary = header([card('SIMPLE', True), card('BITPIX', 8), card('NAXIS', 0), card('EXTEND', True)])
+    maxlen = max(len(t) for t in tiles)
+    rows, heap = b'', b''
+    for i, t in enumerate(tiles):
+        rows += struct.pack('>ii', len(t), len(heap))
+        if scales: rows += struct.pack('>dd', *scales[i])
+        heap += t
+    cards = [card('XTENSION', 'BINTABLE'), card('BITPIX', 8), card('NAXIS', 2),
+             card('NAXIS1', len(rows) // len(tiles)), card('NAXIS2', len(tiles)),
+             card('PCOUNT', len(heap)), card('GCOUNT', 1), card('TFIELDS', 3 if scales else 1),
+             card('TTYPE1', 'COMPRESSED_DATA'), card('TFORM1', '1PB(%d)' % maxlen)]
+    if scales:
+        cards += [card('TTYPE2', 'ZSCALE'), card('TFORM2', '1D'), card('TTYPE3', 'ZZERO'), card('TFORM3', '1D')]
+    cards += [card('ZIMAGE', True), card('ZTILE1', width), card('ZTILE2', 1), card('ZCMPTYPE', 'RICE_1'),
+              card('ZNAME1', 'BLOCKSIZE'), card('ZVAL1', 32), card('ZNAME2', 'BYTEPIX'),
+              card('ZVAL2', 4 if zbitpix < 0 else zbitpix // 8), card('ZBITPIX', zbitpix), card('ZNAXIS', 2),
+              card('ZNAXIS1', width), card('ZNAXIS2', height)] + extra
+    with open(path, 'wb') as f:
+        f.write(primary + header(cards) + pad(rows + heap))
+
+# 16 bit: the pixels of int16Pixel() in tilecompress_test.go
+W, H = 40, 5
+def int16_pixel(x, y):
+    if y == 0: return 1200                                   # low entropy blocks
+    if y == 1: return 100 * x - 2000                         # a ramp
+    if y == 2: return 15000 if x % 2 == 0 else -15000        # high entropy blocks
+    return (x * 7919 + y * 104729) % 61 - 30                 # small noise
+tiles = [rcomp([int16_pixel(x, y) for x in range(W)], 2) for y in range(H)]
+write('rice16.fits.fz', W, H, 16, tiles, [card('BZERO', 32768), card('BSCALE', 1)])
+
+# Quantized 32 bit float, SUBTRACTIVE_DITHER_1: the pixels of floatPixel() in tilecompress_test.go
+def float_pixel(x, y):
+    return struct.unpack('f', struct.pack('f', 1000.0 + 3.25 * x - 7.5 * y + 0.37 * ((x * y) % 11)))[0]
+SCALE, ZERO, ZDITHER0 = 0.125, 1000.0, 17
+tiles, scales = [], []
+for y in range(H):
+    iseed = (y + 1 + ZDITHER0 - 1 - 1) % 10000
+    nextrand = int(RAND[iseed] * 500)
+    q = []
+    for x in range(W):
+        q.append(int(math.floor((float_pixel(x, y) - ZERO) / SCALE + RAND[nextrand] - 0.5 + 0.5)))
+        nextrand += 1
+        if nextrand == 10000:
+            iseed = (iseed + 1) % 10000; nextrand = int(RAND[iseed] * 500)
+    tiles.append(rcomp(q, 4)); scales.append((SCALE, ZERO))
+write('riceq32.fits.fz', W, H, -32, tiles,
+      [card('ZQUANTIZ', 'SUBTRACTIVE_DITHER_1'), card('ZDITHER0', ZDITHER0)], scales)
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// Tile-compressed images (as written by fpack) are stored in a BINTABLE with ZIMAGE = T, one row per
+// tile (FITS standard section 10). decompressImage() rebuilds the data unit of the original image so
+// that it goes through decodeFrameData() like any other. RICE_1 and GZIP_1 are supported, including
+// quantized floating point images.
+
+const nullQuantizedValue = -2147483647 // NULL_VALUE in cfitsio: a quantized pixel that was NaN
+const zeroQuantizedValue = -2147483646 // ZERO_VALUE: an exact zero kept by SUBTRACTIVE_DITHER_2
+
+// Header cards of the compressed HDU that describe the compression or the table rather than the image
+var compressionCardNames = []string{"XTENSION", "ZIMAGE", "ZCMPTYPE", "ZQUANTIZ", "ZDITHER0", "ZSIMPLE",
+	"ZEXTEND", "ZTENSION", "ZPCOUNT", "ZGCOUNT", "ZHECKSUM", "ZDATASUM", "TFIELDS", "PCOUNT", "GCOUNT", "THEAP"}
+
+func isCompressedImage(header *fitsHeader) bool {
+	return header.stringValue("XTENSION") == "BINTABLE" && header.boolValue("ZIMAGE")
+}
+
+func uncompressedHeader(header *fitsHeader) *fitsHeader {
+	// The header of the original image: BITPIX and NAXISn take the values of ZBITPIX and ZNAXISn, and
+	// the cards that only describe the compression are dropped.
+	result := &fitsHeader{headerBytes: header.headerBytes}
+	for _, card := range header.cards {
+		name := card.name
+		switch {
+		case name == "BITPIX":
+			card.value = header.stringValue("ZBITPIX")
+		case strings.HasPrefix(name, "NAXIS"):
+			card.value = header.stringValue("Z" + name)
+		case name == "ZBITPIX" || strings.HasPrefix(name, "ZNAXIS") || strings.HasPrefix(name, "ZTILE") ||
+			strings.HasPrefix(name, "ZNAME") || strings.HasPrefix(name, "ZVAL") ||
+			strings.HasPrefix(name, "TTYPE") || strings.HasPrefix(name, "TFORM"):
+			continue
+		}
+		if containsString(compressionCardNames, name) {
+			continue
+		}
+		result.cards = append(result.cards, card)
+	}
+	return result
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func compressionParameter(header *fitsHeader, name string, fallback int) int {
+	// The ZNAMEn/ZVALn pairs hold algorithm parameters such as BLOCKSIZE and BYTEPIX
+	for i := 1; header.has(fmt.Sprintf("ZNAME%d", i)); i++ {
+		if strings.EqualFold(header.stringValue(fmt.Sprintf("ZNAME%d", i)), name) {
+			return header.intValue(fmt.Sprintf("ZVAL%d", i), fallback)
+		}
+	}
+	return fallback
+}
+
+func decompressImage(table *binTable) ([]byte, *fitsHeader, error) {
+	// Returns the data unit (big-endian, ZBITPIX format) of the first plane and the image header
+	header := table.header
+	algorithm := header.stringValue("ZCMPTYPE")
+	if algorithm != "RICE_1" && algorithm != "GZIP_1" {
+		return nil, nil, fmt.Errorf("%s compression is not supported (only RICE_1 and GZIP_1)", algorithm)
+	}
+	zbitpix := header.intValue("ZBITPIX", 0)
+	width := header.intValue("ZNAXIS1", 0)
+	height := header.intValue("ZNAXIS2", 1)
+	tileWidth := header.intValue("ZTILE1", width)
+	tileHeight := header.intValue("ZTILE2", 1)
+	if width <= 0 || height <= 0 || tileWidth <= 0 || tileHeight <= 0 {
+		return nil, nil, fmt.Errorf("compressed image has no pixels")
+	}
+	quantized := zbitpix < 0 && header.stringValue("ZQUANTIZ") != "NONE"
+
+	dataColumn, ok := table.column("COMPRESSED_DATA")
+	if !ok {
+		return nil, nil, fmt.Errorf("compressed image has no COMPRESSED_DATA column")
+	}
+	scaleColumn, haveScale := table.column("ZSCALE")
+	zeroColumn, haveZero := table.column("ZZERO")
+	if quantized && (!haveScale || !haveZero) {
+		return nil, nil, fmt.Errorf("quantized image has no ZSCALE/ZZERO columns")
+	}
+
+	bytesPerPixel := max(zbitpix, -zbitpix) / 8
+	raw := make([]byte, width*height*bytesPerPixel)
+	tilesAcross := (width + tileWidth - 1) / tileWidth
+	tilesDown := (height + tileHeight - 1) / tileHeight
+	ditherSeed := header.intValue("ZDITHER0", 1)
+	dither := header.stringValue("ZQUANTIZ")
+
+	for tile := range tilesAcross * tilesDown {
+		if tile >= table.numRows {
+			return nil, nil, fmt.Errorf("compressed image has %d tiles but the table has %d rows", tilesAcross*tilesDown, table.numRows)
+		}
+		x0 := (tile % tilesAcross) * tileWidth
+		y0 := (tile / tilesAcross) * tileHeight
+		tw := min(tileWidth, width-x0)
+		th := min(tileHeight, height-y0)
+		numPixels := tw * th
+
+		compressed, err := table.heapArray(tile, dataColumn)
+		if err != nil {
+			return nil, nil, err
+		}
+		var values []int64   // Integer pixels (or quantized values)
+		var floats []float64 // Unquantized floating point pixels (GZIP_1 only)
+		if algorithm == "RICE_1" {
+			bytePix := compressionParameter(header, "BYTEPIX", 4)
+			if !quantized && zbitpix > 0 {
+				bytePix = compressionParameter(header, "BYTEPIX", zbitpix/8)
+			}
+			values, err = riceDecompress(compressed, numPixels, compressionParameter(header, "BLOCKSIZE", 32), bytePix)
+		} else {
+			values, floats, err = gzipDecompress(compressed, numPixels, zbitpix, quantized)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("tile %d: %w", tile+1, err)
+		}
+
+		tilePixels := make([]float64, numPixels)
+		if quantized {
+			scale := table.floatValue(tile, scaleColumn)
+			zero := table.floatValue(tile, zeroColumn)
+			dequantize(values, tilePixels, scale, zero, dither, tile+ditherSeed)
+		}
+
+		for i := range numPixels {
+			offset := ((y0+i/tw)*width + x0 + i%tw) * bytesPerPixel
+			b := raw[offset : offset+bytesPerPixel]
+			switch {
+			case quantized && zbitpix == -32:
+				binary.BigEndian.PutUint32(b, math.Float32bits(float32(tilePixels[i])))
+			case quantized:
+				binary.BigEndian.PutUint64(b, math.Float64bits(tilePixels[i]))
+			case zbitpix == -32:
+				binary.BigEndian.PutUint32(b, math.Float32bits(float32(floats[i])))
+			case zbitpix == -64:
+				binary.BigEndian.PutUint64(b, math.Float64bits(floats[i]))
+			case zbitpix == 8:
+				b[0] = byte(values[i])
+			case zbitpix == 16:
+				binary.BigEndian.PutUint16(b, uint16(values[i]))
+			case zbitpix == 32:
+				binary.BigEndian.PutUint32(b, uint32(values[i]))
+			case zbitpix == 64:
+				binary.BigEndian.PutUint64(b, uint64(values[i]))
+			}
+		}
+	}
+	return raw, uncompressedHeader(header), nil
+}
+
+func gzipDecompress(compressed []byte, numPixels, zbitpix int, quantized bool) ([]int64, []float64, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	bytesPerPixel := max(zbitpix, -zbitpix) / 8
+	if quantized {
+		bytesPerPixel = 4 // Quantized values are 32 bit integers
+	}
+	if len(data) < numPixels*bytesPerPixel {
+		return nil, nil, fmt.Errorf("GZIP_1 tile holds %d bytes, %d needed", len(data), numPixels*bytesPerPixel)
+	}
+	if zbitpix < 0 && !quantized {
+		floats := make([]float64, numPixels)
+		for i := range floats {
+			if zbitpix == -32 {
+				floats[i] = float64(math.Float32frombits(binary.BigEndian.Uint32(data[4*i:])))
+			} else {
+				floats[i] = math.Float64frombits(binary.BigEndian.Uint64(data[8*i:]))
+			}
+		}
+		return nil, floats, nil
+	}
+	values := make([]int64, numPixels)
+	for i := range values {
+		b := data[i*bytesPerPixel:]
+		switch bytesPerPixel {
+		case 1:
+			values[i] = int64(b[0])
+		case 2:
+			values[i] = int64(int16(binary.BigEndian.Uint16(b)))
+		case 4:
+			values[i] = int64(int32(binary.BigEndian.Uint32(b)))
+		case 8:
+			values[i] = int64(binary.BigEndian.Uint64(b))
+		}
+	}
+	return values, nil, nil
+}
+
+func riceDecompress(compressed []byte, numPixels, blockSize, bytePix int) ([]int64, error) {
+	// A port of fits_rdecomp() from cfitsio (ricecomp.c). Each block of blockSize pixels starts with
+	// a code giving the number of low bits (fs) sent verbatim per difference - the high bits are sent
+	// in unary. fs of -1 means a block of zero differences, fsMax a block of uncoded differences.
+	var fsBits, fsMax int
+	switch bytePix {
+	case 1:
+		fsBits, fsMax = 3, 6
+	case 2:
+		fsBits, fsMax = 4, 14
+	case 4:
+		fsBits, fsMax = 5, 25
+	default:
+		return nil, fmt.Errorf("RICE_1 BYTEPIX of %d is not supported", bytePix)
+	}
+	bBits := uint(8 * bytePix)
+	mask := uint32(1<<bBits - 1)
+	if bBits == 32 {
+		mask = math.MaxUint32
+	}
+	if len(compressed) < bytePix+1 {
+		return nil, fmt.Errorf("RICE_1 tile is too short")
+	}
+
+	// The first pixel value is stored uncompressed
+	var lastPix uint32
+	for _, c := range compressed[:bytePix] {
+		lastPix = lastPix<<8 | uint32(c)
+	}
+	pos := bytePix
+	nextByte := func() uint32 {
+		if pos >= len(compressed) {
+			pos += 1
+			return 0
+		}
+		c := compressed[pos]
+		pos += 1
+		return uint32(c)
+	}
+
+	values := make([]int64, numPixels)
+	store := func(i int, diff uint32) {
+		// Undo the mapping of signed differences onto unsigned values
+		if diff&1 == 0 {
+			diff = diff >> 1
+		} else {
+			diff = ^(diff >> 1)
+		}
+		lastPix = (diff + lastPix) & mask
+		switch bytePix {
+		case 1:
+			values[i] = int64(uint8(lastPix))
+		case 2:
+			values[i] = int64(int16(lastPix))
+		default:
+			values[i] = int64(int32(lastPix))
+		}
+	}
+
+	b := nextByte()
+	nBits := 8
+	for i := 0; i < numPixels; {
+		nBits -= fsBits
+		for nBits < 0 {
+			b = b<<8 | nextByte()
+			nBits += 8
+		}
+		fs := int(b>>uint(nBits)) - 1
+		b &= 1<<uint(nBits) - 1
+		iMax := min(i+blockSize, numPixels)
+
+		switch {
+		case fs < 0: // Low entropy block - all differences are zero
+			for ; i < iMax; i++ {
+				store(i, 0)
+			}
+		case fs == fsMax: // High entropy block - differences are sent as bBits bit values
+			for ; i < iMax; i++ {
+				k := int(bBits) - nBits
+				diff := uint32(uint64(b) << uint(k))
+				for k -= 8; k >= 0; k -= 8 {
+					b = nextByte()
+					diff |= b << uint(k)
+				}
+				if nBits > 0 {
+					b = nextByte()
+					diff |= b >> uint(-k)
+					b &= 1<<uint(nBits) - 1
+				} else {
+					b = 0
+				}
+				store(i, diff)
+			}
+		default:
+			for ; i < iMax; i++ {
+				for b == 0 { // Count the leading zeros of the unary part
+					nBits += 8
+					b = nextByte()
+				}
+				nZero := nBits - bits.Len32(b)
+				nBits -= nZero + 1
+				b ^= 1 << uint(nBits) // Clear the one that ends the unary part
+				nBits -= fs
+				for nBits < 0 {
+					b = b<<8 | nextByte()
+					nBits += 8
+				}
+				diff := uint32(nZero)<<uint(fs) | b>>uint(nBits)
+				b &= 1<<uint(nBits) - 1
+				store(i, diff)
+			}
+		}
+		if pos > len(compressed) {
+			return nil, fmt.Errorf("RICE_1 tile ends early")
+		}
+	}
+	return values, nil
+}
+
+// Built when the program starts - frames are decoded by several goroutines at once (the folder scan
+// and the frame cache prefetcher), so the table must never be seen half filled
+var ditherRandoms = makeDitherRandoms()
+
+func makeDitherRandoms() []float64 {
+	// The fixed sequence of random numbers that cfitsio uses for subtractive dithering
+	// (fits_init_randoms() - a Park and Miller generator)
+	const a = 16807.0
+	const m = 2147483647.0
+	seed := 1.0
+	randoms := make([]float64, 10000)
+	for i := range randoms {
+		temp := a * seed
+		seed = temp - m*float64(int64(temp/m))
+		randoms[i] = float64(float32(seed / m)) // cfitsio keeps them as float
+	}
+	return randoms
+}
+
+func dequantize(values []int64, pixels []float64, scale, zero float64, dither string, row int) {
+	// row is the 1-based tile number plus ZDITHER0 - 1, which selects the start of the dither sequence
+	if dither == "" || dither == "NO_DITHER" {
+		for i, value := range values {
+			if value == nullQuantizedValue {
+				pixels[i] = math.NaN()
+			} else {
+				pixels[i] = float64(value)*scale + zero
+			}
+		}
+		return
+	}
+	seedIndex := (row - 1) % 10000
+	next := int(ditherRandoms[seedIndex] * 500)
+	for i, value := range values {
+		switch {
+		case value == nullQuantizedValue:
+			pixels[i] = math.NaN()
+		case value == zeroQuantizedValue && dither == "SUBTRACTIVE_DITHER_2":
+			pixels[i] = 0
+		default:
+			pixels[i] = (float64(value)-ditherRandoms[next]+0.5)*scale + zero
+		}
+		next += 1
+		if next == 10000 {
+			seedIndex = (seedIndex + 1) % 10000
+			next = int(ditherRandoms[seedIndex] * 500)
+		}
+	}
+}
@@ -19,25 +19,21 @@ func findFlashEdges() bool {
 	fc := myWin.lightcurve // Shortened name for flash lightcurve
 
 	//baseStdDev, _ := stats.StandardDeviationPopulation(fc[0:baseZone])
-	baseMean, _ := stats.Mean(fc[0:baseZone])
+	baseMean, _ := stats.Mean(validSamples(fc[0:baseZone])) // Dropped frames (NaN) are left out
 	var maxFlashLevel float64
 	var midFlashLevel float64
 	var foundMaxFlashLevel = false
 	for i := range len(fc) {
 		if fc[i] > flashThresholdFactor*baseMean {
-			if i+2 < len(fc) {
-				maxFlashLevel = fc[i+2]
-				foundMaxFlashLevel = true
-				break
-			} else if i+1 < len(fc) {
-				maxFlashLevel = fc[i+1]
-				foundMaxFlashLevel = true
-				break
-			} else {
-				maxFlashLevel = fc[i]
-				foundMaxFlashLevel = true
-				break
+			// Use the sample two readings in (or the nearest one that is not a dropped frame)
+			for _, k := range []int{i + 2, i + 1, i} {
+				if k < len(fc) && !isMissingSample(fc[k]) {
+					maxFlashLevel = fc[k]
+					foundMaxFlashLevel = true
+					break
+				}
 			}
+			break
 		}
 	}
 
@@ -75,6 +71,24 @@ type EdgeStats struct {
 	totalTimeErr               float64
 }
 
+func flashLevelLimit() (float64, bool) {
+	// The lightcurve is a sum of ADU (BZERO/BSCALE applied), so maxAllowedFlashLevel (out of 255) is
+	// taken as the same fraction of what the folder's integer format can hold: 51400 ADU for the usual
+	// 16 bit frame. Floating point frames have no full scale, so there is no limit for them.
+	if myWin.bitpix < 0 {
+		return math.Inf(1), false
+	}
+	bzero, bscale := 0.0, 1.0
+	for _, path := range myWin.fitsFilePaths {
+		if path != droppedFrameString {
+			bzero, bscale = pixelScaling(path)
+			break
+		}
+	}
+	lo, hi := integerLimits(myWin.bitpix)
+	return bzero + bscale*(float64(lo)+(float64(hi)-float64(lo))*maxAllowedFlashLevel/255), true
+}
+
 func prettyPrintWing(wingName string, values []float64) {
 	log.Printf("\n%s", wingName)
 	for i := 0; i < len(values); i++ {
@@ -87,6 +101,7 @@ func prettyPrintWing(wingName string, values []float64) {
 }
 
 func mean(data []float64) float64 {
+	data = validSamples(data)
 	if len(data) == 0 {
 		return 0.0
 	}
@@ -123,12 +138,13 @@ func getTransitionPointData(flashWing []float64) (meanBottom, stdBottom, meanTop
 	bottom := flashWing[0:a]
 	top := flashWing[a+1 : len(flashWing)-1]
 	meanBottom = mean(bottom)
-	stdBottom, _ = stats.StandardDeviation(bottom)
+	stdBottom, _ = stats.StandardDeviation(validSamples(bottom))
 	meanTop = mean(top)
-	stdTop, _ = stats.StandardDeviation(top)
+	stdTop, _ = stats.StandardDeviation(validSamples(top))
 
-	aIsCandidate := !(flashWing[a] < meanBottom)
-	bIsCandidate := !(flashWing[b] > meanTop)
+	// A dropped frame (NaN) can never be the transition point
+	aIsCandidate := !(flashWing[a] < meanBottom) && !isMissingSample(flashWing[a])
+	bIsCandidate := !(flashWing[b] > meanTop) && !isMissingSample(flashWing[b])
 
 	if !(aIsCandidate || bIsCandidate) {
 		transitionIndex = b
@@ -206,7 +222,8 @@ func extractEdgeTimeAndStats(fc []float64, goalpost string, midFlashLevel float6
 	bottomThresholdForValidTransitionPoint := bottomMean + bottomStd // Arbitrary criteria of  1 std
 
 	averagePixelValueInTop := topMean / float64(myWin.numPixels)
-	log.Printf("average pixel value in top: %0.1f", averagePixelValueInTop)
+	flashLimit, haveFlashLimit := flashLevelLimit()
+	log.Printf("average pixel value in top: %0.1f (limit %0.1f)", averagePixelValueInTop, flashLimit)
 
 	indexOfTransitionPoint := transitionPoint + startingIndex
 	p := fc[indexOfTransitionPoint]
@@ -242,7 +259,7 @@ func extractEdgeTimeAndStats(fc []float64, goalpost string, midFlashLevel float6
 	adjustedSigmaFrame := math.Sqrt(sigmaFrameFromRatio*sigmaFrameFromRatio + sigmaFrame*sigmaFrame)
 	edgeStats.edgeSigma = adjustedSigmaFrame
 
-	if averagePixelValueInTop > maxAllowedFlashLevel {
+	if haveFlashLimit && averagePixelValueInTop > flashLimit {
 		myWin.flashIntensityValid = false
 		log.Println("!!! flash too bright !!!  Setting edgeSigma to 0.5")
 		edgeStats.edgeSigma = 0.5
@@ -273,6 +290,12 @@ func getLeftFlashEdge(fc []float64, midFlashLevel float64) (leftWing []float64)
 
 	for i := 0; i < len(fc); i++ {
 		value := fc[i]
+		if isMissingSample(value) {
+			// A dropped frame tells us nothing about which side of the edge we are on, so it is
+			// kept (to preserve frame positions) without changing state.
+			leftWing = append(leftWing, value)
+			continue
+		}
 		if state == "accumulateBottom" {
 			if value < midFlashLevel {
 				leftWing = append(leftWing, value)
@@ -300,6 +323,10 @@ func getRightFlashEdge(fc []float64, midFlashLevel float64) (rightWing []float64
 
 	for {
 		value := fc[k]
+		if isMissingSample(value) { // A dropped frame does not change state
+			k -= 1
+			continue
+		}
 		if state == "traverseRightBottom" {
 			if value < midFlashLevel { // We're still in the flash off portion of the tail
 				k -= 1
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"image/color"
+	"log"
+	"math"
+	"slices"
+)
+
+// Aperture tracking. A tracked aperture is moved every frame to the flux-weighted centroid of the
+// pixels within its search radius (the median of those pixels is taken off first, so the sky does
+// not pull the centroid towards the middle). A centroid further than the drift limit from where the
+// aperture was is taken to be a mistake - a cosmic ray, a passing satellite, a cloud - and the
+// aperture stays put for that frame. An aperture tied to another one (a faint target tied to a
+// bright tracking star) moves by whatever the other one has moved from its starting position - it
+// can only be tied to a tracked aperture, not to one that is tied itself.
+// After a measurement, the paths of the apertures can be drawn over the image during playback.
+
+const centroidIterations = 3
+const maxPathSegments = 300 // Per aperture path drawn over the image
+
+var pathColors = []color.NRGBA{
+	{R: 0, G: 255, B: 255, A: 255},
+	{R: 255, G: 0, B: 255, A: 255},
+	{R: 0, G: 255, B: 0, A: 255},
+	{R: 255, G: 160, B: 0, A: 255},
+}
+
+type imagePoint struct {
+	X float64
+	Y float64
+}
+
+func (a aperture) center() imagePoint {
+	if a.Shape == shapeCircle {
+		return imagePoint{a.CenterX, a.CenterY}
+	}
+	return imagePoint{float64(a.X0+a.X1) / 2, float64(a.Y0+a.Y1) / 2}
+}
+
+func (a aperture) size() float64 {
+	// The radius of a circle, half the smaller side of a rectangle
+	if a.Shape == shapeCircle {
+		return a.Radius
+	}
+	return float64(min(a.X1-a.X0, a.Y1-a.Y0)) / 2
+}
+
+func (a aperture) moves() bool {
+	return a.Track || a.TiedTo != ""
+}
+
+func (a aperture) movedTo(center imagePoint) aperture {
+	// A rectangle moves by whole pixels
+	start := a.center()
+	dx := int(math.Round(center.X - start.X))
+	dy := int(math.Round(center.Y - start.Y))
+	a.X0, a.X1, a.Y0, a.Y1 = a.X0+dx, a.X1+dx, a.Y0+dy, a.Y1+dy
+	a.CenterX, a.CenterY = center.X, center.Y
+	return a
+}
+
+func centroid(frame *frameData, at imagePoint, radius float64) (imagePoint, bool) {
+	for i := 0; i < centroidIterations; i++ {
+		x0 := max(0, int(math.Floor(at.X-radius)))
+		x1 := min(frame.width-1, int(math.Ceil(at.X+radius)))
+		y0 := max(0, int(math.Floor(at.Y-radius)))
+		y1 := min(frame.height-1, int(math.Ceil(at.Y+radius)))
+		var xs, ys, values []float64
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				dx := float64(x) + 0.5 - at.X
+				dy := float64(y) + 0.5 - at.Y
+				if value := frame.at(x, y); dx*dx+dy*dy <= radius*radius && !math.IsNaN(value) {
+					xs = append(xs, float64(x)+0.5)
+					ys = append(ys, float64(y)+0.5)
+					values = append(values, value)
+				}
+			}
+		}
+		if len(values) == 0 {
+			return at, false
+		}
+		background := median(slices.Clone(values))
+		var sumW, sumX, sumY float64
+		for k, value := range values {
+			if w := value - background; w > 0 {
+				sumW += w
+				sumX += w * xs[k]
+				sumY += w * ys[k]
+			}
+		}
+		if sumW <= 0 {
+			return at, false // Nothing above the background - a blank sky, or the star has gone
+		}
+		at = imagePoint{sumX / sumW, sumY / sumW}
+	}
+	return at, true
+}
+
+func trackApertures(frame *frameData, apertures []aperture, start, current []imagePoint) (numRejected int) {
+	// Moves current (the aperture centers in the previous frame) to where they are in frame
+	for i, a := range apertures {
+		if !a.Track || a.TiedTo != "" {
+			continue
+		}
+		found, ok := centroid(frame, current[i], a.SearchRadius)
+		if !ok || math.Hypot(found.X-current[i].X, found.Y-current[i].Y) > a.DriftLimit {
+			numRejected += 1
+			continue
+		}
+		current[i] = found
+	}
+	for i, a := range apertures {
+		if j := trackerIndex(apertures, a.TiedTo); j >= 0 {
+			current[i] = imagePoint{start[i].X + current[j].X - start[j].X, start[i].Y + current[j].Y - start[j].Y}
+		}
+	}
+	return numRejected
+}
+
+func trackerIndex(apertures []aperture, name string) int {
+	// An aperture can only be tied to one that is tracked itself (and so not tied), so every tracker
+	// has been moved before any aperture that follows it. -1 when there is no such aperture.
+	for j, a := range apertures {
+		if a.Name == name && a.Track && a.TiedTo == "" {
+			return j
+		}
+	}
+	return -1
+}
+
+func removeDanglingTies() bool {
+	// Unties the apertures of myWin.apertures whose tracker has been deleted (or is no longer tracked).
+	// Returns true when there were any.
+	changed := false
+	for i, a := range myWin.apertures {
+		if a.TiedTo != "" && trackerIndex(myWin.apertures, a.TiedTo) < 0 {
+			log.Printf("aperture %s was tied to %s, which is not a tracked aperture - it is no longer tied\n",
+				a.Name, a.TiedTo)
+			myWin.apertures[i].TiedTo = ""
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (v *imageView) placeTrackOverlay() {
+	// The path of every aperture that moves and where each aperture is in the displayed frame
+	v.trackOverlay.Objects = nil
+	results := myWin.apertureResults
+	if !myWin.showAperturePaths || results == nil || v.image.Image == nil ||
+		len(results.paths) != len(myWin.fitsFilePaths) {
+		v.trackOverlay.Refresh()
+		return
+	}
+	bounds := v.image.Image.Bounds()
+	inView := func(p imagePoint) bool {
+		return p.X >= float64(bounds.Min.X) && p.X <= float64(bounds.Max.X) &&
+			p.Y >= float64(bounds.Min.Y) && p.Y <= float64(bounds.Max.Y)
+	}
+	_, scale := v.imageLayout()
+	for i, a := range results.apertures {
+		pathColor := pathColors[i%len(pathColors)]
+		centers := results.centers[i]
+		if a.moves() {
+			step := max(1, len(centers)/maxPathSegments)
+			for k := step; k < len(centers); k += step {
+				from, to := centers[k-step], centers[k]
+				if !inView(from) || !inView(to) {
+					continue
+				}
+				segment := canvas.NewLine(pathColor)
+				segment.StrokeWidth = 1
+				segment.Position1 = v.toWidgetPos(from.X, from.Y)
+				segment.Position2 = v.toWidgetPos(to.X, to.Y)
+				v.trackOverlay.Objects = append(v.trackOverlay.Objects, segment)
+			}
+		}
+		if myWin.fileIndex < len(centers) && inView(centers[myWin.fileIndex]) {
+			now := centers[myWin.fileIndex]
+			radius := float32(a.size()) * scale
+			marker := canvas.NewCircle(color.Transparent)
+			marker.StrokeColor = pathColor
+			marker.StrokeWidth = 2
+			marker.Move(v.toWidgetPos(now.X, now.Y).Subtract(fyne.NewPos(radius, radius)))
+			marker.Resize(fyne.NewSize(2*radius, 2*radius))
+			v.trackOverlay.Objects = append(v.trackOverlay.Objects, marker)
+		}
+	}
+	v.trackOverlay.Refresh()
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Export of a range of frames as a video: an animated GIF, or an AVI holding MJPEG or uncompressed
+// (24 bit DIB) frames. Every frame goes through renderFrame(), so the video shows the display levels,
+// stretch and export area (whole frame or ROI), with the caption when it is enabled. The AVI is
+// written frame by frame; the GIF encoder needs all of its frames at once, so GIFs are limited in size.
+
+const videoGIF = "animated GIF"
+const videoMJPEG = "AVI (MJPEG)"
+const videoRaw = "AVI (uncompressed)"
+
+var videoFormats = []string{videoGIF, videoMJPEG, videoRaw}
+
+const maxGifBytes = 512 << 20 // Paletted frames held in memory for a GIF
+
+func loadVideoSettings() {
+	prefs := myWin.App.Preferences()
+	myWin.videoFormat = prefs.StringWithFallback("VideoFormat", videoGIF)
+	myWin.videoFPS = prefs.FloatWithFallback("VideoFPS", 10)
+}
+
+func videoExtension() string {
+	if myWin.videoFormat == videoGIF {
+		return ".gif"
+	}
+	return ".avi"
+}
+
+// videoWriter is implemented by gifWriter and aviWriter
+type videoWriter interface {
+	addFrame(img image.Image) error
+	close() error
+}
+
+type gifWriter struct {
+	file *os.File
+	anim gif.GIF
+	// Frames are delayed in 1/100 s. The fractions left over are carried to the next frame so that
+	// the average frame rate is right.
+	delay     float64
+	carried   float64
+	numBytes  int
+	grayscale bool
+}
+
+func newGifWriter(file *os.File, fps float64, grayscale bool) *gifWriter {
+	return &gifWriter{file: file, delay: 100 / fps, grayscale: grayscale} // A LoopCount of 0 loops forever
+}
+
+func grayPalette() color.Palette {
+	// 255 grays and magenta for invalid pixels
+	p := make(color.Palette, 0, 256)
+	for i := 0; i < 255; i++ {
+		level := uint8(i * 255 / 254)
+		p = append(p, color.Gray{Y: level})
+	}
+	return append(p, invalidPixelColor)
+}
+
+func (w *gifWriter) addFrame(img image.Image) error {
+	bounds := img.Bounds()
+	w.numBytes += bounds.Dx() * bounds.Dy()
+	if w.numBytes > maxGifBytes {
+		return fmt.Errorf("the GIF would be too large to make - choose fewer frames, the ROI, or an AVI format")
+	}
+	var paletted *image.Paletted
+	if w.grayscale {
+		paletted = image.NewPaletted(bounds, grayPalette())
+		draw.Draw(paletted, bounds, img, bounds.Min, draw.Src)
+	} else {
+		paletted = image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+	}
+	w.carried += w.delay
+	delay := int(math.Round(w.carried))
+	w.carried -= float64(delay)
+	w.anim.Image = append(w.anim.Image, paletted)
+	w.anim.Delay = append(w.anim.Delay, delay)
+	return nil
+}
+
+func (w *gifWriter) close() error {
+	err := gif.EncodeAll(w.file, &w.anim)
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type aviIndexEntry struct {
+	offset uint32 // From the 'movi' fourcc
+	size   uint32
+}
+
+type aviWriter struct {
+	file       *os.File
+	mjpeg      bool
+	fps        float64
+	width      int
+	height     int
+	moviStart  int64 // File offset of the 'movi' fourcc
+	index      []aviIndexEntry
+	maxChunk   uint32
+	headerDone bool
+}
+
+func newAviWriter(file *os.File, fps float64, mjpeg bool) *aviWriter {
+	return &aviWriter{file: file, fps: fps, mjpeg: mjpeg}
+}
+
+func writeLE(buf *bytes.Buffer, values ...any) {
+	for _, value := range values {
+		_ = binary.Write(buf, binary.LittleEndian, value) // Writes to a bytes.Buffer do not fail
+	}
+}
+
+func (w *aviWriter) header() []byte {
+	// RIFF/AVI header up to and including the start of the movi list. The sizes, frame count and
+	// largest chunk are only known at the end, so close() writes the header again over this one.
+	compression := uint32(0) // BI_RGB
+	handler := []byte("DIB ")
+	if w.mjpeg {
+		compression = binary.LittleEndian.Uint32([]byte("MJPG"))
+		handler = []byte("MJPG")
+	}
+	numFrames := uint32(len(w.index))
+	rate := uint32(math.Round(w.fps * 1000))
+	imageSize := uint32(w.rowBytes() * w.height)
+
+	var strl bytes.Buffer
+	strl.WriteString("strh")
+	writeLE(&strl, uint32(56))
+	strl.WriteString("vids")
+	strl.Write(handler)
+	writeLE(&strl, uint32(0), uint16(0), uint16(0), uint32(0), // flags, priority, language, initial frames
+		uint32(1000), rate, uint32(0), numFrames, w.maxChunk, // scale, rate (frames per second = rate/scale), start, length
+		int32(-1), uint32(0), // quality, sample size
+		int16(0), int16(0), int16(w.width), int16(w.height)) // frame rectangle
+	strl.WriteString("strf")
+	writeLE(&strl, uint32(40), // BITMAPINFOHEADER
+		uint32(40), int32(w.width), int32(w.height), uint16(1), uint16(24), compression, imageSize,
+		int32(0), int32(0), uint32(0), uint32(0))
+
+	var hdrl bytes.Buffer
+	hdrl.WriteString("avih")
+	writeLE(&hdrl, uint32(56),
+		uint32(math.Round(1e6/w.fps)), uint32(float64(w.maxChunk)*w.fps), uint32(0), // µs per frame, max bytes/s, padding
+		uint32(0x10), numFrames, uint32(0), uint32(1), w.maxChunk, // AVIF_HASINDEX, frames, initial frames, streams
+		uint32(w.width), uint32(w.height), uint32(0), uint32(0), uint32(0), uint32(0))
+	hdrl.WriteString("LIST")
+	writeLE(&hdrl, uint32(4+strl.Len()))
+	hdrl.WriteString("strl")
+	hdrl.Write(strl.Bytes())
+
+	moviSize := uint32(4)
+	for _, entry := range w.index {
+		moviSize += 8 + entry.size + entry.size%2
+	}
+	riffSize := 4 + (12 + uint32(hdrl.Len())) + (8 + moviSize) + (8 + 16*numFrames)
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	writeLE(&out, riffSize)
+	out.WriteString("AVI LIST")
+	writeLE(&out, uint32(4+hdrl.Len()))
+	out.WriteString("hdrl")
+	out.Write(hdrl.Bytes())
+	out.WriteString("LIST")
+	writeLE(&out, moviSize)
+	return out.Bytes()
+}
+
+func (w *aviWriter) rowBytes() int {
+	return (3*w.width + 3) &^ 3 // DIB rows are padded to 4 bytes
+}
+
+func (w *aviWriter) addFrame(img image.Image) error {
+	bounds := img.Bounds()
+	if !w.headerDone {
+		w.width, w.height = bounds.Dx(), bounds.Dy()
+		header := w.header()
+		if _, err := w.file.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.file.Write([]byte("movi")); err != nil {
+			return err
+		}
+		w.moviStart = int64(len(header))
+		w.headerDone = true
+	}
+
+	var data bytes.Buffer
+	if w.mjpeg {
+		if err := jpeg.Encode(&data, img, &jpeg.Options{Quality: 90}); err != nil {
+			return err
+		}
+	} else {
+		// Bottom-up rows of BGR
+		row := make([]byte, w.rowBytes())
+		for y := bounds.Max.Y - 1; y >= bounds.Min.Y; y-- {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				k := 3 * (x - bounds.Min.X)
+				row[k], row[k+1], row[k+2] = c.B, c.G, c.R
+			}
+			data.Write(row)
+		}
+	}
+
+	position, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	var chunk bytes.Buffer
+	chunk.WriteString("00dc")
+	writeLE(&chunk, uint32(data.Len()))
+	chunk.Write(data.Bytes())
+	if data.Len()%2 == 1 {
+		chunk.WriteByte(0) // Chunks are padded to an even length
+	}
+	if _, err = w.file.Write(chunk.Bytes()); err != nil {
+		return err
+	}
+	w.index = append(w.index, aviIndexEntry{offset: uint32(position - w.moviStart), size: uint32(data.Len())})
+	w.maxChunk = max(w.maxChunk, uint32(data.Len()))
+	return nil
+}
+
+func (w *aviWriter) close() error {
+	err := w.finish()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *aviWriter) finish() error {
+	if !w.headerDone {
+		return fmt.Errorf("no frames were written")
+	}
+	var idx1 bytes.Buffer
+	idx1.WriteString("idx1")
+	writeLE(&idx1, uint32(16*len(w.index)))
+	for _, entry := range w.index {
+		idx1.WriteString("00dc")
+		writeLE(&idx1, uint32(0x10), entry.offset, entry.size) // AVIIF_KEYFRAME
+	}
+	if _, err := w.file.Write(idx1.Bytes()); err != nil {
+		return err
+	}
+	// The header is the same length whatever the counts, so it can be rewritten in place
+	_, err := w.file.WriteAt(w.header(), 0)
+	return err
+}
+
+func writeVideo(path string, first, last int, progress *widget.ProgressBar) (int, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	var writer videoWriter
+	switch myWin.videoFormat {
+	case videoGIF:
+		writer = newGifWriter(file, myWin.videoFPS, myWin.shownFrame != nil && !myWin.shownFrame.isColor())
+	default:
+		writer = newAviWriter(file, myWin.videoFPS, myWin.videoFormat == videoMJPEG)
+	}
+
+	numWritten := 0
+	for k := first; k <= last; k++ {
+		progress.SetValue(float64(k-first) / float64(last-first+1))
+		path := myWin.fitsFilePaths[k]
+		if path == droppedFrameString {
+			continue
+		}
+		frame, _, timestamp, err := loadFrame(path)
+		if err != nil {
+			_ = file.Close()
+			return numWritten, err
+		}
+		img := renderFrame(frame, false)
+		if myWin.exportCaption {
+			drawCaption(img, fmt.Sprintf("frame %d  %s", k, timestamp))
+		}
+		if err := writer.addFrame(img); err != nil {
+			_ = file.Close()
+			return numWritten, err
+		}
+		numWritten += 1
+	}
+	return numWritten, writer.close()
+}
+
+func exportVideo(firstText, lastText string, win fyne.Window) {
+	if len(myWin.fitsImages) == 0 {
+		return
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(firstText))
+	last, err2 := strconv.Atoi(strings.TrimSpace(lastText))
+	if err1 != nil || err2 != nil || first < 0 || last >= len(myWin.fitsFilePaths) || first > last {
+		dialog.ShowInformation("Export video",
+			fmt.Sprintf("The first and last frames must be frame numbers from 0 to %d, first <= last.",
+				len(myWin.fitsFilePaths)-1), win)
+		return
+	}
+
+	fileSave := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+		if err != nil || writer == nil {
+			return
+		}
+		path := writer.URI().Path()
+		_ = writer.Close()
+		progress := widget.NewProgressBar()
+		busy := dialog.NewCustomWithoutButtons(fmt.Sprintf("Writing frames %d to %d", first, last), progress, win)
+		busy.Show()
+		go func() {
+			numWritten, err := writeVideo(path, first, last, progress)
+			busy.Hide()
+			if err != nil {
+				_ = os.Remove(path)
+				dialog.ShowInformation("Export video", err.Error(), win)
+				return
+			}
+			log.Printf("%d frames (%d to %d) written to %s as %s at %g fps\n",
+				numWritten, first, last, path, myWin.videoFormat, myWin.videoFPS)
+		}()
+	}, win)
+	fileSave.SetFileName(fmt.Sprintf("frames_%d_%d%s", first, last, videoExtension()))
+	showFileSave(fileSave)
+}
+
+func videoControls(win fyne.Window) fyne.CanvasObject {
+	// The video part of the Export frames window
+	formatSelector := widget.NewSelect(videoFormats, func(opt string) {
+		myWin.videoFormat = opt
+		myWin.App.Preferences().SetString("VideoFormat", opt)
+	})
+	formatSelector.Selected = myWin.videoFormat
+
+	fpsEntry := widget.NewEntry()
+	fpsEntry.SetText(strconv.FormatFloat(myWin.videoFPS, 'f', -1, 64))
+	fpsEntry.OnChanged = func(text string) {
+		fps, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil || fps < 0.1 || fps > 100 {
+			return
+		}
+		myWin.videoFPS = fps
+		myWin.App.Preferences().SetFloat("VideoFPS", fps)
+	}
+
+	// The range starts out as the loop range (or all of the frames)
+	first, last := 0, max(len(myWin.fitsFilePaths)-1, 0)
+	if myWin.loopStartIndex >= 0 && myWin.loopEndIndex >= 0 {
+		first = min(myWin.loopStartIndex, myWin.loopEndIndex)
+		last = min(max(myWin.loopStartIndex, myWin.loopEndIndex), last)
+	}
+	firstEntry := widget.NewEntry()
+	firstEntry.SetText(strconv.Itoa(first))
+	lastEntry := widget.NewEntry()
+	lastEntry.SetText(strconv.Itoa(last))
+
+	return container.NewVBox(
+		widget.NewForm(
+			widget.NewFormItem("Video format", formatSelector),
+			widget.NewFormItem("Frames per second (0.1 to 100)", fpsEntry),
+			widget.NewFormItem("First frame", firstEntry),
+			widget.NewFormItem("Last frame", lastEntry),
+		),
+		widget.NewButton("Export video...", func() { exportVideo(firstEntry.Text, lastEntry.Text, win) }),
+	)
+}